@@ -0,0 +1,361 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Address is a single address assigned to an interface.
+type Address struct {
+	Prefix netip.Prefix
+	// Peer is the remote end of a point-to-point link, optional.
+	Peer netip.Addr
+	// Label is an IPv4 alias label, usually the interface name with a suffix.
+	Label string
+	Scope uint8
+	// Flags are IFA_F_* flags, see unix.IFA_F_NODAD and friends.
+	Flags uint32
+}
+
+// AddAddress adds a to the interface, it fails if the address exists.
+func (IF *Interface) AddAddress(a Address) (err error) {
+	return IF.changeAddress(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, a)
+}
+
+// ReplaceAddress adds a to the interface or updates it if it exists.
+func (IF *Interface) ReplaceAddress(a Address) (err error) {
+	return IF.changeAddress(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, a)
+}
+
+// DelAddress removes a from the interface.
+func (IF *Interface) DelAddress(a Address) (err error) {
+	return IF.changeAddress(unix.RTM_DELADDR, 0, a)
+}
+
+// ListAddresses returns every address assigned to the interface.
+func (IF *Interface) ListAddresses() (list []Address, err error) {
+	var index int
+	var replies [][]byte
+
+	err = IF.do(func() (err error) {
+		if index, err = linkIndex(IF.Name); err != nil {
+			return err
+		}
+
+		var ifa unix.IfAddrmsg
+		m := newNetlinkMessage(unix.RTM_GETADDR, unix.NLM_F_DUMP, unsafe.Pointer(&ifa), unix.SizeofIfAddrmsg)
+		replies, err = netlinkExecute("getaddr", m)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range replies {
+		if len(r) < unix.SizeofIfAddrmsg {
+			continue
+		}
+		msg := (*unix.IfAddrmsg)(unsafe.Pointer(&r[0]))
+		if int(msg.Index) != index {
+			continue
+		}
+		list = append(list, parseAddress(msg, parseNetlinkAttrs(r[unix.SizeofIfAddrmsg:])))
+	}
+
+	return
+}
+
+func parseAddress(msg *unix.IfAddrmsg, attrs netlinkAttrs) (a Address) {
+	local := attrs.get(unix.IFA_LOCAL)
+	address := attrs.get(unix.IFA_ADDRESS)
+	if local == nil {
+		local = address
+	}
+
+	ip, _ := netip.AddrFromSlice(local)
+	a.Prefix = netip.PrefixFrom(ip, int(msg.Prefixlen))
+	if peer, ok := netip.AddrFromSlice(address); ok && peer != ip {
+		a.Peer = peer
+	}
+	a.Label = attrs.string(unix.IFA_LABEL)
+	a.Scope = msg.Scope
+	a.Flags = uint32(msg.Flags)
+	if attrs.get(unix.IFA_FLAGS) != nil {
+		a.Flags = attrs.uint32(unix.IFA_FLAGS)
+	}
+	return
+}
+
+func (IF *Interface) changeAddress(msgType uint16, flags uint16, a Address) (err error) {
+	if !a.Prefix.IsValid() {
+		return errors.New("invalid address prefix")
+	}
+
+	change := func() error {
+		return IF.do(func() error {
+			return IF.changeAddressInNS(msgType, flags, a)
+		})
+	}
+
+	e, journaled := IF.journalEntry(JournalAddress)
+	e.Address = &a
+	if journaled && msgType == unix.RTM_NEWADDR {
+		return journalChange(e, change)
+	}
+
+	if err = change(); err != nil {
+		return err
+	}
+
+	if journaled && msgType == unix.RTM_DELADDR {
+		return journalRevert(e)
+	}
+	return nil
+}
+
+func (IF *Interface) changeAddressInNS(msgType uint16, flags uint16, a Address) (err error) {
+	index, err := linkIndex(IF.Name)
+	if err != nil {
+		return err
+	}
+
+	ip := a.Prefix.Addr().Unmap()
+	ifa := unix.IfAddrmsg{
+		Family:    syscall.AF_INET,
+		Prefixlen: uint8(a.Prefix.Bits()),
+		Scope:     a.Scope,
+		Index:     uint32(index),
+	}
+	if ip.Is6() {
+		ifa.Family = syscall.AF_INET6
+	}
+
+	m := newNetlinkMessage(msgType, flags, unsafe.Pointer(&ifa), unix.SizeofIfAddrmsg)
+	m.addAttr(unix.IFA_LOCAL, ip.AsSlice())
+	if a.Peer.IsValid() {
+		m.addAttr(unix.IFA_ADDRESS, a.Peer.Unmap().AsSlice())
+	} else {
+		m.addAttr(unix.IFA_ADDRESS, ip.AsSlice())
+	}
+	if a.Label != "" {
+		m.addString(unix.IFA_LABEL, a.Label)
+	}
+	if a.Flags != 0 {
+		m.addUint32(unix.IFA_FLAGS, a.Flags)
+	}
+
+	op := "newaddr"
+	if msgType == unix.RTM_DELADDR {
+		op = "deladdr"
+	}
+
+	_, err = netlinkExecute(op, m)
+	return
+}
+
+// ipv4Prefix combines IF.IPv4Address and IF.NetMask into a prefix. The
+// address can also be given in CIDR notation, in which case NetMask is
+// only used when it is set.
+func (IF *Interface) ipv4Prefix() (prefix netip.Prefix, err error) {
+	var ip netip.Addr
+	bits := 32
+
+	if strings.Contains(IF.IPv4Address, "/") {
+		prefix, err = netip.ParsePrefix(IF.IPv4Address)
+		if err != nil {
+			return
+		}
+		ip, bits = prefix.Addr(), prefix.Bits()
+	} else {
+		ip, err = netip.ParseAddr(IF.IPv4Address)
+		if err != nil {
+			return
+		}
+	}
+
+	if !ip.Is4() {
+		return prefix, errors.New("invalid IPv4 address: " + IF.IPv4Address)
+	}
+
+	if IF.NetMask != "" {
+		mask := net.ParseIP(IF.NetMask).To4()
+		if mask == nil {
+			return prefix, errors.New("invalid netmask: " + IF.NetMask)
+		}
+		ones, size := net.IPMask(mask).Size()
+		if size == 0 {
+			return prefix, errors.New("netmask is not contiguous: " + IF.NetMask)
+		}
+		bits = ones
+	}
+
+	return netip.PrefixFrom(ip, bits), nil
+}
+
+// setLink applies a RTM_NEWLINK change to the interface. The attributes
+// are added by fn.
+func (IF *Interface) setLink(op string, flags uint32, change uint32, fn func(m *netlinkMessage)) (err error) {
+	return IF.do(func() error {
+		index, err := linkIndex(IF.Name)
+		if err != nil {
+			return err
+		}
+
+		ifi := unix.IfInfomsg{
+			Family: syscall.AF_UNSPEC,
+			Index:  int32(index),
+			Flags:  flags,
+			Change: change,
+		}
+
+		m := newNetlinkMessage(unix.RTM_NEWLINK, 0, unsafe.Pointer(&ifi), unix.SizeofIfInfomsg)
+		if fn != nil {
+			fn(m)
+		}
+
+		_, err = netlinkExecute(op, m)
+		return err
+	})
+}
+
+// Address flags, see Address.Flags.
+const (
+	AddrFlagNoDAD          = unix.IFA_F_NODAD
+	AddrFlagOptimistic     = unix.IFA_F_OPTIMISTIC
+	AddrFlagHomeAddress    = unix.IFA_F_HOMEADDRESS
+	AddrFlagManageTempAddr = unix.IFA_F_MANAGETEMPADDR
+	AddrFlagNoPrefixRoute  = unix.IFA_F_NOPREFIXROUTE
+	AddrFlagTentative      = unix.IFA_F_TENTATIVE
+	AddrFlagDADFailed      = unix.IFA_F_DADFAILED
+)
+
+// Address scopes, see Address.Scope.
+const (
+	ScopeUniverse = unix.RT_SCOPE_UNIVERSE
+	ScopeSite     = unix.RT_SCOPE_SITE
+	ScopeLink     = unix.RT_SCOPE_LINK
+	ScopeHost     = unix.RT_SCOPE_HOST
+)
+
+var ErrDADFailed = errors.New("duplicate address detection failed")
+
+// Syscall_Addrv6 assigns IF.IPv6Address to the interface. The address can
+// be given in CIDR notation, without a prefix length it is added as a /128.
+// IF.IPv6Flags and IF.IPv6Scope are applied to the address and when
+// IF.DADTimeout is set it waits for duplicate address detection to finish,
+// which requires the interface to be up.
+func (IF *Interface) Syscall_Addrv6() (err error) {
+	prefix, err := IF.ipv6Prefix()
+	if err != nil {
+		return err
+	}
+
+	if err = IF.enableIPv6(); err != nil {
+		return err
+	}
+
+	if err = IF.ReplaceAddress(Address{
+		Prefix: prefix,
+		Scope:  IF.IPv6Scope,
+		Flags:  IF.IPv6Flags,
+	}); err != nil {
+		return err
+	}
+
+	if IF.DADTimeout > 0 && IF.IPv6Flags&AddrFlagNoDAD == 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), IF.DADTimeout)
+		defer cancel()
+		return IF.WaitDAD(ctx, prefix.Addr())
+	}
+
+	return
+}
+
+// WaitDAD waits until duplicate address detection has finished for addr.
+// It returns ErrDADFailed if the address is a duplicate.
+func (IF *Interface) WaitDAD(ctx context.Context, addr netip.Addr) (err error) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		addrs, err := IF.ListAddresses()
+		if err != nil {
+			return err
+		}
+
+		found := false
+		for _, a := range addrs {
+			if a.Prefix.Addr() != addr {
+				continue
+			}
+			found = true
+			if a.Flags&AddrFlagDADFailed != 0 {
+				return ErrDADFailed
+			}
+			if a.Flags&AddrFlagTentative == 0 {
+				return nil
+			}
+		}
+		if !found {
+			return errors.New("address not found on interface: " + addr.String())
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (IF *Interface) ipv6Prefix() (prefix netip.Prefix, err error) {
+	if strings.Contains(IF.IPv6Address, "/") {
+		prefix, err = netip.ParsePrefix(IF.IPv6Address)
+	} else {
+		var ip netip.Addr
+		ip, err = netip.ParseAddr(IF.IPv6Address)
+		prefix = netip.PrefixFrom(ip, 128)
+	}
+	if err != nil {
+		return
+	}
+
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return prefix, errors.New("invalid IPv6 address: " + IF.IPv6Address)
+	}
+	return
+}
+
+// enableIPv6 makes sure IPv6 is not disabled on the interface, the kernel
+// refuses IPv6 addresses on interfaces where it is.
+func (IF *Interface) enableIPv6() (err error) {
+	return IF.do(IF.enableIPv6InNS)
+}
+
+func (IF *Interface) enableIPv6InNS() (err error) {
+	path := "/proc/sys/net/ipv6/conf/" + IF.Name + "/disable_ipv6"
+
+	current, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return errors.New("IPv6 is not available on " + IF.Name)
+		}
+		return err
+	}
+	if strings.TrimSpace(string(current)) == "0" {
+		return nil
+	}
+
+	return os.WriteFile(path, []byte("0"), 0o644)
+}
@@ -0,0 +1,332 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmsghdr is the struct mmsghdr used by recvmmsg and sendmmsg.
+type mmsghdr struct {
+	Hdr unix.Msghdr
+	Len uint32
+}
+
+// ReadBatch reads up to len(bufs) packets, the length of each one is
+// stored in sizes. It blocks until at least one packet is ready and then
+// returns every packet that can be read without blocking. With IF.IOUring
+// the packets come from the reads posted on the ring.
+//
+// With IF.VnetHdr set super-packets are read and split into bufs, a
+// super-packet that does not fit in what is left of bufs is kept for the
+// next call.
+func (IF *Interface) ReadBatch(bufs [][]byte, sizes []int) (n int, err error) {
+	if IF.uring != nil {
+		n, err = IF.uring.ReadBatch(bufs, sizes)
+		for i := 0; i < n; i++ {
+			IF.counters.countRead(sizes[i], len(bufs[i]), nil)
+		}
+		if err != nil {
+			IF.counters.countRead(0, 0, err)
+		}
+		return n, err
+	}
+
+	T, ok := IF.RWC.(*TunFile)
+	if !ok {
+		return 0, errors.New("interface is not open")
+	}
+	if !IF.VnetHdr {
+		return T.ReadBatch(bufs, sizes)
+	}
+
+	if IF.vnetReadBuf == nil {
+		IF.vnetReadBuf = make([]byte, VnetMaxPacket)
+	}
+
+	for n < len(bufs) {
+		if IF.vnetPending == nil {
+			var size [1]int
+			if _, err = T.readBatch([][]byte{IF.vnetReadBuf}, size[:], n == 0); err != nil {
+				if n > 0 && errors.Is(err, syscall.EAGAIN) {
+					err = nil
+				}
+				return n, err
+			}
+			IF.vnetPending = IF.vnetReadBuf[:size[0]]
+		}
+
+		var hdr VirtioNetHdr
+		if err = hdr.Decode(IF.vnetPending); err != nil {
+			IF.vnetPending = nil
+			return n, err
+		}
+
+		count, err := GSOSplit(IF.vnetPending[VnetHdrLen:], hdr, bufs[n:], sizes[n:])
+		if errors.Is(err, syscall.ENOBUFS) && n > 0 {
+			break
+		}
+		IF.vnetPending = nil
+		if err != nil {
+			return n, err
+		}
+		n += count
+	}
+
+	return n, nil
+}
+
+// WriteBatch writes every packet in bufs and returns how many were
+// written. With IF.VnetHdr set the packets are coalesced into
+// super-packets, see WritePackets.
+func (IF *Interface) WriteBatch(bufs [][]byte) (n int, err error) {
+	if IF.VnetHdr {
+		return IF.WritePackets(bufs)
+	}
+
+	T, ok := IF.RWC.(*TunFile)
+	if !ok {
+		return 0, errors.New("interface is not open")
+	}
+	return T.WriteBatch(bufs)
+}
+
+// ReadBatch reads up to len(bufs) packets, the length of each one is
+// stored in sizes. It waits in the runtime poller until at least one
+// packet is ready and then reads until the device is empty, so a burst
+// of packets costs a single wakeup.
+func (T *TunFile) ReadBatch(bufs [][]byte, sizes []int) (n int, err error) {
+	return T.readBatch(bufs, sizes, true)
+}
+
+func (T *TunFile) readBatch(bufs [][]byte, sizes []int, block bool) (n int, err error) {
+	if len(sizes) < len(bufs) {
+		return 0, errors.New("sizes is shorter than bufs")
+	}
+
+	rc, err := T.File.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	rerr := rc.Read(func(fd uintptr) bool {
+		for n < len(bufs) {
+			size, e := syscall.Read(int(fd), bufs[n])
+			if e == syscall.EINTR {
+				continue
+			}
+			if e == syscall.EAGAIN {
+				if n == 0 && !block {
+					err = e
+					return true
+				}
+				return n > 0
+			}
+			if e != nil {
+				err = os.NewSyscallError("read", e)
+				return true
+			}
+			T.counters.countRead(size, len(bufs[n]), nil)
+			sizes[n] = size
+			n++
+		}
+		return true
+	})
+	if err == nil {
+		err = rawConnErr(rerr)
+	}
+	if err != nil {
+		T.counters.countRead(0, 0, err)
+	}
+
+	return n, err
+}
+
+// WriteBatch writes every packet in bufs, waiting in the runtime poller
+// whenever the device queue is full. It returns the number of packets
+// written.
+func (T *TunFile) WriteBatch(bufs [][]byte) (n int, err error) {
+	rc, err := T.File.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	werr := rc.Write(func(fd uintptr) bool {
+		for n < len(bufs) {
+			size, e := syscall.Write(int(fd), bufs[n])
+			if e == syscall.EINTR {
+				continue
+			}
+			if e == syscall.EAGAIN {
+				return false
+			}
+			if e != nil {
+				err = os.NewSyscallError("write", e)
+				return true
+			}
+			T.counters.countWrite(size, len(bufs[n]), T.limit, nil)
+			n++
+		}
+		return true
+	})
+	if err == nil {
+		err = rawConnErr(werr)
+	}
+	if err != nil {
+		T.counters.countWrite(0, 0, 0, err)
+	}
+
+	return n, err
+}
+
+// ReadBatch receives up to len(bufs) packets with a single recvmmsg call,
+// the length of each one is stored in sizes. It blocks like Read until at
+// least one packet is waiting. With r.IOUring it blocks until the posted
+// reads on the ring complete instead. In ring mode the frames are copied
+// out of the RX ring, it blocks until one is ready.
+func (r *RawSocket) ReadBatch(bufs [][]byte, sizes []int) (n int, err error) {
+	if r.ring != nil {
+		if len(sizes) < len(bufs) {
+			return 0, errors.New("sizes is shorter than bufs")
+		}
+		return r.ring.readBatch(bufs, sizes)
+	}
+	if r.uring != nil {
+		return r.uring.ReadBatch(bufs, sizes)
+	}
+
+	if len(sizes) < len(bufs) {
+		return 0, errors.New("sizes is shorter than bufs")
+	}
+	if len(bufs) == 0 {
+		return 0, nil
+	}
+
+	if cap(r.readMsgs) < len(bufs) {
+		r.readMsgs = make([]mmsghdr, len(bufs))
+		r.readIovs = make([]unix.Iovec, len(bufs))
+	}
+	msgs := r.readMsgs[:len(bufs)]
+	iovs := r.readIovs[:len(bufs)]
+
+	for i := range bufs {
+		iovs[i] = unix.Iovec{}
+		if len(bufs[i]) > 0 {
+			iovs[i].Base = &bufs[i][0]
+		}
+		iovs[i].SetLen(len(bufs[i]))
+		msgs[i] = mmsghdr{}
+		msgs[i].Hdr.Iov = &iovs[i]
+		msgs[i].Hdr.SetIovlen(1)
+	}
+
+	perr := pollRead(r.rc, r.BusyPoll, func(fd int) bool {
+		for {
+			r0, _, e1 := syscall.Syscall6(
+				unix.SYS_RECVMMSG,
+				uintptr(fd),
+				uintptr(unsafe.Pointer(&msgs[0])),
+				uintptr(len(msgs)),
+				0,
+				0,
+				0,
+			)
+			switch e1 {
+			case 0:
+				n = int(r0)
+			case syscall.EINTR:
+				continue
+			case syscall.EAGAIN:
+				return false
+			default:
+				err = e1
+			}
+			return true
+		}
+	})
+	if err == nil {
+		err = perr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < n; i++ {
+		sizes[i] = int(msgs[i].Len)
+	}
+	return n, nil
+}
+
+// WriteBatch sends every IPv4 and IPv6 packet in bufs with sendmmsg, the
+// destination of each packet is taken from its header. It returns the
+// number of packets sent. In ring mode bufs are ethernet frames, they
+// are queued on the TX ring and sent with a single call.
+func (r *RawSocket) WriteBatch(bufs [][]byte) (n int, err error) {
+	if r.ring != nil {
+		return r.ring.writeBatch(bufs)
+	}
+	if len(bufs) == 0 {
+		return 0, nil
+	}
+
+	if cap(r.writeMsgs) < len(bufs) {
+		r.writeMsgs = make([]mmsghdr, len(bufs))
+		r.writeIovs = make([]unix.Iovec, len(bufs))
+		r.writeAddrs = make([]syscall.RawSockaddrInet6, len(bufs))
+		r.writeFds = make([]int, len(bufs))
+	}
+	msgs := r.writeMsgs[:len(bufs)]
+	iovs := r.writeIovs[:len(bufs)]
+	addrs := r.writeAddrs[:len(bufs)]
+	fds := r.writeFds[:len(bufs)]
+
+	for i, b := range bufs {
+		fd, salen, err := r.destination(b, &addrs[i])
+		if err != nil {
+			return 0, err
+		}
+		fds[i] = fd
+
+		iovs[i] = unix.Iovec{Base: &b[0]}
+		iovs[i].SetLen(len(b))
+
+		msgs[i] = mmsghdr{}
+		msgs[i].Hdr.Name = (*byte)(unsafe.Pointer(&addrs[i]))
+		msgs[i].Hdr.Namelen = salen
+		msgs[i].Hdr.Iov = &iovs[i]
+		msgs[i].Hdr.SetIovlen(1)
+	}
+
+	// each run of packets of the same family goes out in one call, the
+	// kernel can stop early so keep going from where it stopped
+	for n < len(msgs) {
+		end := n + 1
+		for end < len(msgs) && fds[end] == fds[n] {
+			end++
+		}
+
+		r0, _, e1 := syscall.Syscall6(
+			unix.SYS_SENDMMSG,
+			uintptr(fds[n]),
+			uintptr(unsafe.Pointer(&msgs[n])),
+			uintptr(end-n),
+			0,
+			0,
+			0,
+		)
+		if e1 == syscall.EINTR {
+			continue
+		}
+		if e1 != 0 {
+			return n, e1
+		}
+		n += int(r0)
+	}
+
+	return n, nil
+}
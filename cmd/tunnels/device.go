@@ -0,0 +1,465 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/zveinn/tunnels"
+	"golang.org/x/sys/unix"
+)
+
+// device is what list and show report about a TUN/TAP interface.
+type device struct {
+	Name            string
+	Index           int
+	Type            string
+	MTU             int
+	TxQueuelen      int
+	Up              bool
+	Persistent      bool
+	Multiqueue      bool
+	VnetHdr         bool
+	Owner           int
+	Group           int
+	HardwareAddress string `json:",omitempty"`
+	Addresses       []tunnels.Address
+}
+
+// readDevice collects the state of a TUN/TAP interface from sysfs and
+// netlink. Owner and Group are -1 when they are not set.
+func readDevice(name string) (d device, err error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return d, err
+	}
+
+	sys := filepath.Join("/sys/class/net", name)
+	flags, err := readSysInt(sys, "tun_flags", 16)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return d, fmt.Errorf("%s is not a TUN/TAP interface", name)
+		}
+		return d, err
+	}
+
+	d = device{
+		Name:       ifi.Name,
+		Index:      ifi.Index,
+		Type:       "tun",
+		MTU:        ifi.MTU,
+		Up:         ifi.Flags&net.FlagUp != 0,
+		Persistent: flags&unix.IFF_PERSIST != 0,
+		Multiqueue: flags&unix.IFF_MULTI_QUEUE != 0,
+		VnetHdr:    flags&unix.IFF_VNET_HDR != 0,
+	}
+	if flags&unix.IFF_TAP != 0 {
+		d.Type = "tap"
+		d.HardwareAddress = ifi.HardwareAddr.String()
+	}
+
+	if d.TxQueuelen, err = readSysInt(sys, "tx_queue_len", 10); err != nil {
+		return d, err
+	}
+	if d.Owner, err = readSysInt(sys, "owner", 10); err != nil {
+		return d, err
+	}
+	if d.Group, err = readSysInt(sys, "group", 10); err != nil {
+		return d, err
+	}
+
+	IF := &tunnels.Interface{Name: name}
+	d.Addresses, err = IF.ListAddresses()
+	return d, err
+}
+
+func readSysInt(dir string, file string, base int) (int, error) {
+	b, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseInt(strings.TrimPrefix(strings.TrimSpace(string(b)), "0x"), base, 64)
+	return int(v), err
+}
+
+// listDevices returns every TUN/TAP interface on the system.
+func listDevices() (devices []device, err error) {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ifi := range ifis {
+		if _, err := os.Stat(filepath.Join("/sys/class/net", ifi.Name, "tun_flags")); err != nil {
+			continue
+		}
+		d, err := readDevice(ifi.Name)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+
+	return devices, nil
+}
+
+func cmdCreate(args []string) (err error) {
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	tap := fs.Bool("tap", false, "create a TAP interface instead of TUN")
+	multiqueue := fs.Bool("multiqueue", false, "enable multiple queues")
+	mtu := fs.Int("mtu", 0, "MTU")
+	txqueuelen := fs.Int("txqueuelen", 0, "transmit queue length")
+	owner := fs.String("user", "", "owner of the interface")
+	group := fs.String("group", "", "group of the interface")
+	hwaddr := fs.String("hwaddr", "", "MAC address of a TAP interface")
+	up := fs.Bool("up", false, "bring the interface up")
+	var addrs listFlag
+	fs.Var(&addrs, "addr", "address in CIDR notation, can be repeated")
+
+	pos, err := parseArgs(fs, args, 1, "NAME")
+	if err != nil {
+		return err
+	}
+
+	if _, err = net.InterfaceByName(pos[0]); err == nil {
+		return fmt.Errorf("interface %s already exists", pos[0])
+	}
+
+	IF := &tunnels.Interface{
+		Name:            pos[0],
+		TAP:             *tap,
+		Multiqueue:      *multiqueue,
+		HardwareAddress: *hwaddr,
+		Persistent:      true,
+	}
+	if *owner != "" {
+		if IF.User, err = lookupUser(*owner); err != nil {
+			return err
+		}
+	}
+	if *group != "" {
+		if IF.Group, err = lookupGroup(*group); err != nil {
+			return err
+		}
+	}
+
+	spec := tunnels.Spec{
+		MTU:        int32(*mtu),
+		TxQueuelen: int32(*txqueuelen),
+		Up:         up,
+	}
+	for _, a := range addrs {
+		prefix, err := netip.ParsePrefix(a)
+		if err != nil {
+			return err
+		}
+		spec.Addresses = append(spec.Addresses, tunnels.Address{Prefix: prefix})
+	}
+
+	actions, err := IF.Apply(spec)
+	if perr := printActions(actions); perr != nil && err == nil {
+		err = perr
+	}
+	return err
+}
+
+func printActions(actions []tunnels.Action) error {
+	if jsonOutput {
+		if actions == nil {
+			actions = []tunnels.Action{}
+		}
+		return printJSON(actions)
+	}
+	for _, a := range actions {
+		fmt.Println(a)
+	}
+	return nil
+}
+
+func cmdDelete(args []string) (err error) {
+	fs := flag.NewFlagSet("delete", flag.ContinueOnError)
+	pos, err := parseArgs(fs, args, 1, "NAME")
+	if err != nil {
+		return err
+	}
+
+	if _, err = readDevice(pos[0]); err != nil {
+		return err
+	}
+
+	IF := &tunnels.Interface{Name: pos[0]}
+	return IF.Syscall_Delete()
+}
+
+func cmdList(args []string) (err error) {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	if _, err = parseArgs(fs, args, 0, "no arguments"); err != nil {
+		return err
+	}
+
+	devices, err := listDevices()
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		if devices == nil {
+			devices = []device{}
+		}
+		return printJSON(devices)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tSTATE\tMTU\tQLEN\tOWNER\tGROUP\tPERSIST\tADDRESSES")
+	for _, d := range devices {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\t%s\t%t\t%s\n",
+			d.Name, d.Type, state(d.Up), d.MTU, d.TxQueuelen,
+			id(d.Owner), id(d.Group), d.Persistent, addresses(d.Addresses),
+		)
+	}
+	return w.Flush()
+}
+
+func cmdShow(args []string) (err error) {
+	fs := flag.NewFlagSet("show", flag.ContinueOnError)
+	pos, err := parseArgs(fs, args, 1, "NAME")
+	if err != nil {
+		return err
+	}
+
+	d, err := readDevice(pos[0])
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return printJSON(d)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "name:\t%s\n", d.Name)
+	fmt.Fprintf(w, "index:\t%d\n", d.Index)
+	fmt.Fprintf(w, "type:\t%s\n", d.Type)
+	fmt.Fprintf(w, "state:\t%s\n", state(d.Up))
+	fmt.Fprintf(w, "mtu:\t%d\n", d.MTU)
+	fmt.Fprintf(w, "txqueuelen:\t%d\n", d.TxQueuelen)
+	fmt.Fprintf(w, "owner:\t%s\n", id(d.Owner))
+	fmt.Fprintf(w, "group:\t%s\n", id(d.Group))
+	fmt.Fprintf(w, "persistent:\t%t\n", d.Persistent)
+	fmt.Fprintf(w, "multiqueue:\t%t\n", d.Multiqueue)
+	fmt.Fprintf(w, "vnet header:\t%t\n", d.VnetHdr)
+	if d.HardwareAddress != "" {
+		fmt.Fprintf(w, "hwaddr:\t%s\n", d.HardwareAddress)
+	}
+	for _, a := range d.Addresses {
+		fmt.Fprintf(w, "address:\t%s\n", a.Prefix)
+	}
+	return w.Flush()
+}
+
+func cmdSet(args []string) (err error) {
+	fs := flag.NewFlagSet("set", flag.ContinueOnError)
+	mtu := fs.Int("mtu", 0, "MTU")
+	txqueuelen := fs.Int("txqueuelen", 0, "transmit queue length")
+	owner := fs.String("user", "", "owner of the interface")
+	group := fs.String("group", "", "group of the interface")
+	persist := fs.Bool("persist", true, "keep the interface when it is not in use")
+	up := fs.Bool("up", false, "bring the interface up")
+	down := fs.Bool("down", false, "bring the interface down")
+
+	pos, err := parseArgs(fs, args, 1, "NAME")
+	if err != nil {
+		return err
+	}
+	if *up && *down {
+		return errors.New("set: -up and -down can not be used together")
+	}
+
+	d, err := readDevice(pos[0])
+	if err != nil {
+		return err
+	}
+
+	IF := &tunnels.Interface{
+		Name:       d.Name,
+		TAP:        d.Type == "tap",
+		Multiqueue: d.Multiqueue,
+		VnetHdr:    d.VnetHdr,
+		Persistent: d.Persistent,
+	}
+
+	if isSet(fs, "mtu") {
+		IF.MTU = int32(*mtu)
+		if err = IF.Syscall_MTU(); err != nil {
+			return err
+		}
+	}
+	if isSet(fs, "txqueuelen") {
+		IF.TxQueuelen = int32(*txqueuelen)
+		if err = IF.Syscall_TXQueuelen(); err != nil {
+			return err
+		}
+	}
+
+	// owner, group and persistence can only be changed through a file
+	// descriptor attached to the device
+	if *owner != "" || *group != "" || isSet(fs, "persist") {
+		if *owner != "" {
+			if IF.User, err = lookupUser(*owner); err != nil {
+				return err
+			}
+		}
+		if *group != "" {
+			if IF.Group, err = lookupGroup(*group); err != nil {
+				return err
+			}
+		}
+		if err = IF.Create(); err != nil {
+			return err
+		}
+		defer IF.RWC.Close()
+
+		if isSet(fs, "persist") && *persist != d.Persistent {
+			if err = IF.Syscall_Persist(*persist); err != nil {
+				return err
+			}
+		}
+	}
+
+	if *up {
+		return IF.Syscall_UP()
+	}
+	if *down {
+		return IF.Syscall_DOWN()
+	}
+	return nil
+}
+
+func cmdAddr(args []string) (err error) {
+	if len(args) == 0 {
+		return errors.New("addr: expected add, del or list")
+	}
+
+	fs := flag.NewFlagSet("addr "+args[0], flag.ContinueOnError)
+	switch args[0] {
+	case "add", "del":
+		pos, err := parseArgs(fs, args[1:], 2, "NAME PREFIX")
+		if err != nil {
+			return err
+		}
+		prefix, err := netip.ParsePrefix(pos[1])
+		if err != nil {
+			return err
+		}
+
+		IF := &tunnels.Interface{Name: pos[0]}
+		if args[0] == "add" {
+			return IF.AddAddress(tunnels.Address{Prefix: prefix})
+		}
+		return IF.DelAddress(tunnels.Address{Prefix: prefix})
+
+	case "list":
+		pos, err := parseArgs(fs, args[1:], 1, "NAME")
+		if err != nil {
+			return err
+		}
+
+		IF := &tunnels.Interface{Name: pos[0]}
+		list, err := IF.ListAddresses()
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput {
+			if list == nil {
+				list = []tunnels.Address{}
+			}
+			return printJSON(list)
+		}
+		for _, a := range list {
+			fmt.Println(a.Prefix)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("addr: unknown command %q", args[0])
+}
+
+func cmdStats(args []string) (err error) {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	watch := fs.Duration("watch", 0, "print the counters again every interval")
+	pos, err := parseArgs(fs, args, 1, "NAME")
+	if err != nil {
+		return err
+	}
+
+	for {
+		stats, err := tunnels.LinkStatistics(pos[0])
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput {
+			if err = printJSON(stats); err != nil {
+				return err
+			}
+		} else if err = printStats(stats); err != nil {
+			return err
+		}
+
+		if *watch <= 0 {
+			return nil
+		}
+		time.Sleep(*watch)
+		if !jsonOutput {
+			fmt.Println()
+		}
+	}
+}
+
+// printStats prints every counter on its own line, in the order of the
+// LinkStats fields.
+func printStats(stats tunnels.LinkStats) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	v := reflect.ValueOf(stats)
+	for i := 0; i < v.NumField(); i++ {
+		fmt.Fprintf(w, "%s:\t%d\n", v.Type().Field(i).Name, v.Field(i).Uint())
+	}
+	return w.Flush()
+}
+
+func state(up bool) string {
+	if up {
+		return "up"
+	}
+	return "down"
+}
+
+func id(v int) string {
+	if v < 0 {
+		return "-"
+	}
+	return strconv.Itoa(v)
+}
+
+func addresses(list []tunnels.Address) string {
+	if len(list) == 0 {
+		return "-"
+	}
+	s := make([]string, len(list))
+	for i, a := range list {
+		s[i] = a.Prefix.String()
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,151 @@
+//go:build linux
+
+// Command tunnels creates and manages TUN/TAP interfaces.
+//
+//	tunnels [-json] <command> [flags] [args]
+//
+// Interfaces created by tunnels are persistent, they stay around after
+// the command exits until they are deleted.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+const usage = `usage: tunnels [-json] <command> [flags] [args]
+
+commands:
+  create NAME [-tap] [-multiqueue] [-mtu N] [-txqueuelen N] [-user USER]
+              [-group GROUP] [-hwaddr MAC] [-addr PREFIX]... [-up]
+  delete NAME
+  list
+  show NAME
+  set NAME [-mtu N] [-txqueuelen N] [-user USER] [-group GROUP]
+           [-persist=true|false] [-up] [-down]
+  addr add|del NAME PREFIX
+  addr list NAME
+  route add|replace|del DST [-via GATEWAY] [-dev NAME] [-src ADDR]
+                            [-metric N] [-table N] [-mtu N]
+  route list [-table N] [-dev NAME] [-4] [-6]
+  stats NAME [-watch INTERVAL]
+
+DST is a prefix, a single address, default or default6.
+`
+
+var jsonOutput bool
+
+type command func(args []string) error
+
+var commands = map[string]command{
+	"create": cmdCreate,
+	"delete": cmdDelete,
+	"list":   cmdList,
+	"show":   cmdShow,
+	"set":    cmdSet,
+	"addr":   cmdAddr,
+	"route":  cmdRoute,
+	"stats":  cmdStats,
+}
+
+func main() {
+	flag.BoolVar(&jsonOutput, "json", false, "print output as JSON")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "tunnels: unknown command %q\n\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := cmd(flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "tunnels:", err)
+		os.Exit(1)
+	}
+}
+
+// parseArgs parses flags that appear before, between or after the
+// positional arguments and checks that exactly n positional arguments
+// were given.
+func parseArgs(fs *flag.FlagSet, args []string, n int, names string) (positional []string, err error) {
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	for {
+		if err = fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	if len(positional) != n {
+		return nil, fmt.Errorf("%s: expected %s", fs.Name(), names)
+	}
+	return positional, nil
+}
+
+// isSet reports whether the flag was given on the command line.
+func isSet(fs *flag.FlagSet, name string) (set bool) {
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return
+}
+
+// lookupUser accepts a user name or a numeric uid.
+func lookupUser(name string) (uint, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint(id), nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(u.Uid, 10, 32)
+	return uint(id), err
+}
+
+// lookupGroup accepts a group name or a numeric gid.
+func lookupGroup(name string) (uint, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint(id), nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(g.Gid, 10, 32)
+	return uint(id), err
+}
+
+// listFlag collects every value of a flag that can be repeated.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,161 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"strings"
+	"syscall"
+
+	"github.com/zveinn/tunnels"
+)
+
+func cmdRoute(args []string) (err error) {
+	if len(args) == 0 {
+		return errors.New("route: expected add, replace, del or list")
+	}
+
+	switch args[0] {
+	case "add", "replace", "del":
+		return changeRoute(args[0], args[1:])
+	case "list":
+		return listRoutes(args[1:])
+	}
+
+	return fmt.Errorf("route: unknown command %q", args[0])
+}
+
+func changeRoute(op string, args []string) (err error) {
+	fs := flag.NewFlagSet("route "+op, flag.ContinueOnError)
+	via := fs.String("via", "", "gateway address")
+	dev := fs.String("dev", "", "output interface")
+	src := fs.String("src", "", "preferred source address")
+	metric := fs.Uint("metric", 0, "route metric")
+	table := fs.Uint("table", 0, "routing table, defaults to main")
+	mtu := fs.Uint("mtu", 0, "path MTU of the route")
+
+	pos, err := parseArgs(fs, args, 1, "DST")
+	if err != nil {
+		return err
+	}
+
+	r := tunnels.Route{
+		Interface: *dev,
+		Metric:    uint32(*metric),
+		Table:     uint32(*table),
+		MTU:       uint32(*mtu),
+	}
+	if r.Dst, err = parsePrefix(pos[0]); err != nil {
+		return err
+	}
+	if *via != "" {
+		if r.Gateway, err = netip.ParseAddr(*via); err != nil {
+			return err
+		}
+	}
+	if *src != "" {
+		if r.Src, err = netip.ParseAddr(*src); err != nil {
+			return err
+		}
+	}
+
+	switch op {
+	case "add":
+		return tunnels.RouteAdd(r)
+	case "replace":
+		return tunnels.RouteReplace(r)
+	}
+	return tunnels.RouteDel(r)
+}
+
+// parsePrefix accepts a prefix, a single address or "default".
+func parsePrefix(s string) (netip.Prefix, error) {
+	switch s {
+	case "default":
+		return netip.MustParsePrefix("0.0.0.0/0"), nil
+	case "default6":
+		return netip.MustParsePrefix("::/0"), nil
+	}
+
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+func listRoutes(args []string) (err error) {
+	fs := flag.NewFlagSet("route list", flag.ContinueOnError)
+	table := fs.Uint("table", tunnels.TableMain, "routing table, 0 for every table")
+	dev := fs.String("dev", "", "only routes through this interface")
+	v4 := fs.Bool("4", false, "only IPv4 routes")
+	v6 := fs.Bool("6", false, "only IPv6 routes")
+
+	if _, err = parseArgs(fs, args, 0, "no arguments"); err != nil {
+		return err
+	}
+
+	family := syscall.AF_UNSPEC
+	if *v4 && !*v6 {
+		family = syscall.AF_INET
+	} else if *v6 && !*v4 {
+		family = syscall.AF_INET6
+	}
+
+	all, err := tunnels.RouteList(family, uint32(*table))
+	if err != nil {
+		return err
+	}
+
+	routes := []tunnels.Route{}
+	for _, r := range all {
+		if *dev == "" || r.Interface == *dev {
+			routes = append(routes, r)
+		}
+	}
+
+	if jsonOutput {
+		return printJSON(routes)
+	}
+	for _, r := range routes {
+		fmt.Println(formatRoute(r))
+	}
+	return nil
+}
+
+// formatRoute prints a route in the style of ip route.
+func formatRoute(r tunnels.Route) string {
+	var b strings.Builder
+
+	if r.Dst.Bits() == 0 {
+		b.WriteString("default")
+	} else {
+		b.WriteString(r.Dst.String())
+	}
+	if r.Gateway.IsValid() {
+		fmt.Fprintf(&b, " via %s", r.Gateway)
+	}
+	if r.Interface != "" {
+		fmt.Fprintf(&b, " dev %s", r.Interface)
+	}
+	if r.Table != tunnels.TableMain {
+		fmt.Fprintf(&b, " table %d", r.Table)
+	}
+	if r.Src.IsValid() {
+		fmt.Fprintf(&b, " src %s", r.Src)
+	}
+	if r.Metric != 0 {
+		fmt.Fprintf(&b, " metric %d", r.Metric)
+	}
+	if r.MTU != 0 {
+		fmt.Fprintf(&b, " mtu %d", r.MTU)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,293 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+type EventType int
+
+const (
+	EventLinkAdded EventType = iota
+	EventLinkDeleted
+	EventLinkUp
+	EventLinkDown
+	EventCarrierUp
+	EventCarrierDown
+	EventAddressAdded
+	EventAddressRemoved
+	EventRouteAdded
+	EventRouteRemoved
+	// EventDefaultRouteChanged is sent along with EventRouteAdded and
+	// EventRouteRemoved when the route is a default route in the main table.
+	EventDefaultRouteChanged
+	// EventOverflow means the kernel dropped events because they were not
+	// read fast enough, state should be re-read from the kernel.
+	EventOverflow
+)
+
+var eventNames = map[EventType]string{
+	EventLinkAdded:           "link-added",
+	EventLinkDeleted:         "link-deleted",
+	EventLinkUp:              "link-up",
+	EventLinkDown:            "link-down",
+	EventCarrierUp:           "carrier-up",
+	EventCarrierDown:         "carrier-down",
+	EventAddressAdded:        "address-added",
+	EventAddressRemoved:      "address-removed",
+	EventRouteAdded:          "route-added",
+	EventRouteRemoved:        "route-removed",
+	EventDefaultRouteChanged: "default-route-changed",
+	EventOverflow:            "overflow",
+}
+
+func (t EventType) String() string {
+	return eventNames[t]
+}
+
+// Event is a single change reported by the kernel. Address is set for
+// address events and Route for route events.
+type Event struct {
+	Type      EventType
+	Index     int
+	Interface string
+	Address   Address
+	Route     Route
+}
+
+// linkState is what we remember about a link to detect changes.
+type linkState struct {
+	name  string
+	flags uint32
+}
+
+// EventStream delivers link, address and route events on Events until
+// it is closed.
+type EventStream struct {
+	Events <-chan Event
+
+	file   *os.File
+	events chan Event
+	done   chan struct{}
+	links  map[int]linkState
+	index  int
+	once   sync.Once
+}
+
+// Subscribe starts listening for link, address and route events on
+// the whole system.
+func Subscribe() (stream *EventStream, err error) {
+	return subscribe(0)
+}
+
+// Subscribe starts listening for events in the namespace of the interface.
+// Only events for the interface itself and default route changes are sent.
+func (IF *Interface) Subscribe() (stream *EventStream, err error) {
+	err = IF.do(func() (err error) {
+		index, err := linkIndex(IF.Name)
+		if err != nil {
+			return err
+		}
+		stream, err = subscribe(index)
+		return err
+	})
+	return
+}
+
+func subscribe(index int) (stream *EventStream, err error) {
+	fd, err := syscall.Socket(
+		syscall.AF_NETLINK,
+		syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK,
+		syscall.NETLINK_ROUTE,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = syscall.Bind(fd, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK |
+			unix.RTMGRP_IPV4_IFADDR |
+			unix.RTMGRP_IPV6_IFADDR |
+			unix.RTMGRP_IPV4_ROUTE |
+			unix.RTMGRP_IPV6_ROUTE,
+	}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	stream = &EventStream{
+		file:   os.NewFile(uintptr(fd), "netlink_events"),
+		events: make(chan Event, 64),
+		done:   make(chan struct{}),
+		links:  make(map[int]linkState),
+		index:  index,
+	}
+	stream.Events = stream.events
+
+	// the current links are read after subscribing so no change is
+	// missed, they are needed to tell what changed in later messages.
+	if err = stream.loadLinks(); err != nil {
+		stream.file.Close()
+		return nil, err
+	}
+
+	go stream.run()
+	return stream, nil
+}
+
+// Close stops the stream, Events is closed once the reader has exited.
+func (E *EventStream) Close() (err error) {
+	E.once.Do(func() {
+		close(E.done)
+		err = E.file.Close()
+	})
+	return
+}
+
+func (E *EventStream) loadLinks() (err error) {
+	var ifi unix.IfInfomsg
+	m := newNetlinkMessage(unix.RTM_GETLINK, unix.NLM_F_DUMP, unsafe.Pointer(&ifi), unix.SizeofIfInfomsg)
+
+	replies, err := netlinkExecute("getlink", m)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range replies {
+		if len(r) < unix.SizeofIfInfomsg {
+			continue
+		}
+		msg := (*unix.IfInfomsg)(unsafe.Pointer(&r[0]))
+		E.links[int(msg.Index)] = linkState{
+			name:  parseNetlinkAttrs(r[unix.SizeofIfInfomsg:]).string(unix.IFLA_IFNAME),
+			flags: msg.Flags,
+		}
+	}
+	return
+}
+
+func (E *EventStream) run() {
+	defer close(E.events)
+
+	buf := make([]byte, 1<<16)
+	for {
+		n, err := E.file.Read(buf)
+		if err != nil {
+			if errors.Is(err, syscall.ENOBUFS) {
+				E.send(Event{Type: EventOverflow})
+				continue
+			}
+			return
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		for _, msg := range msgs {
+			E.handle(msg)
+		}
+	}
+}
+
+func (E *EventStream) send(e Event) {
+	if E.index != 0 && e.Type != EventOverflow && e.Type != EventDefaultRouteChanged && e.Index != E.index {
+		return
+	}
+
+	select {
+	case E.events <- e:
+	case <-E.done:
+	}
+}
+
+func (E *EventStream) handle(msg syscall.NetlinkMessage) {
+	switch msg.Header.Type {
+	case unix.RTM_NEWLINK, unix.RTM_DELLINK:
+		if len(msg.Data) < unix.SizeofIfInfomsg {
+			return
+		}
+		ifi := (*unix.IfInfomsg)(unsafe.Pointer(&msg.Data[0]))
+		index := int(ifi.Index)
+		name := parseNetlinkAttrs(msg.Data[unix.SizeofIfInfomsg:]).string(unix.IFLA_IFNAME)
+		e := Event{Index: index, Interface: name}
+
+		if msg.Header.Type == unix.RTM_DELLINK {
+			delete(E.links, index)
+			e.Type = EventLinkDeleted
+			E.send(e)
+			return
+		}
+
+		old, known := E.links[index]
+		E.links[index] = linkState{name: name, flags: ifi.Flags}
+		if !known {
+			e.Type = EventLinkAdded
+			E.send(e)
+			return
+		}
+
+		changed := old.flags ^ ifi.Flags
+		if changed&syscall.IFF_UP != 0 {
+			e.Type = EventLinkDown
+			if ifi.Flags&syscall.IFF_UP != 0 {
+				e.Type = EventLinkUp
+			}
+			E.send(e)
+		}
+		if changed&unix.IFF_LOWER_UP != 0 {
+			e.Type = EventCarrierDown
+			if ifi.Flags&unix.IFF_LOWER_UP != 0 {
+				e.Type = EventCarrierUp
+			}
+			E.send(e)
+		}
+
+	case unix.RTM_NEWADDR, unix.RTM_DELADDR:
+		if len(msg.Data) < unix.SizeofIfAddrmsg {
+			return
+		}
+		ifa := (*unix.IfAddrmsg)(unsafe.Pointer(&msg.Data[0]))
+		e := Event{
+			Type:      EventAddressAdded,
+			Index:     int(ifa.Index),
+			Interface: E.links[int(ifa.Index)].name,
+			Address:   parseAddress(ifa, parseNetlinkAttrs(msg.Data[unix.SizeofIfAddrmsg:])),
+		}
+		if msg.Header.Type == unix.RTM_DELADDR {
+			e.Type = EventAddressRemoved
+		}
+		E.send(e)
+
+	case unix.RTM_NEWROUTE, unix.RTM_DELROUTE:
+		r, ok := parseRoute(msg.Data)
+		if !ok {
+			return
+		}
+		r.Interface = E.links[r.Index].name
+		e := Event{
+			Type:      EventRouteAdded,
+			Index:     r.Index,
+			Interface: r.Interface,
+			Route:     r,
+		}
+		if msg.Header.Type == unix.RTM_DELROUTE {
+			e.Type = EventRouteRemoved
+		}
+		E.send(e)
+
+		if r.Dst.Bits() == 0 && r.Table == unix.RT_TABLE_MAIN {
+			e.Type = EventDefaultRouteChanged
+			E.send(e)
+		}
+	}
+}
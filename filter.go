@@ -0,0 +1,363 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// LinkType is the header in front of the IP header of the packets a
+// filter sees.
+type LinkType int
+
+const (
+	// LinkIP is for packets that start with the IP header, raw IP
+	// sockets and sockets in ring mode on a TUN device.
+	LinkIP LinkType = iota
+	// LinkEthernet is for ethernet frames, sockets in ring mode on an
+	// ethernet or TAP device. VLAN tagged frames never match.
+	LinkEthernet
+)
+
+// Direction selects which addresses and ports of a packet a Filter
+// matches.
+type Direction int
+
+const (
+	// DirAny matches either the source or the destination.
+	DirAny Direction = iota
+	// DirSrc matches the source only.
+	DirSrc
+	// DirDst matches the destination only.
+	DirDst
+)
+
+// Filter matches IP packets, every field that is set has to match. IPv6
+// extension headers are not followed, so an IPv6 packet with extension
+// headers only matches a filter without Protocol and Ports.
+type Filter struct {
+	// Version is 4 or 6 to match a single IP version, zero matches both
+	// unless Net decides it.
+	Version int
+	// Protocol is the IP protocol number, zero matches any protocol.
+	Protocol uint8
+	// Net matches an address, a single host is a /32 or /128 prefix.
+	Net netip.Prefix
+	// Ports matches a TCP, UDP or SCTP port, any one of them. Fragments
+	// other than the first never match.
+	Ports []uint16
+	// Direction applies to Net and Ports.
+	Direction Direction
+}
+
+// filterAccept is the number of bytes kept from a matching packet, all.
+const filterAccept = 0xffffffff
+
+// label is a jump target in a program under construction.
+type label int
+
+const (
+	next label = -1
+	// labels below are resolved by CompileFilter
+	labelAccept label = -2
+	labelReject label = -3
+)
+
+// bpfInsn is an instruction whose jumps still point at labels.
+type bpfInsn struct {
+	unix.SockFilter
+	jt, jf label
+	ja     bool
+}
+
+// bpfAsm collects instructions and resolves labels to relative jumps.
+type bpfAsm struct {
+	insns  []bpfInsn
+	labels []int
+}
+
+func (A *bpfAsm) newLabel() label {
+	A.labels = append(A.labels, -1)
+	return label(len(A.labels) - 1)
+}
+
+func (A *bpfAsm) mark(l label) {
+	A.labels[l] = len(A.insns)
+}
+
+func (A *bpfAsm) stmt(code uint16, k uint32) {
+	A.insns = append(A.insns, bpfInsn{
+		SockFilter: unix.SockFilter{Code: code, K: k},
+		jt:         next,
+		jf:         next,
+	})
+}
+
+func (A *bpfAsm) jump(code uint16, k uint32, jt label, jf label) {
+	A.insns = append(A.insns, bpfInsn{
+		SockFilter: unix.SockFilter{Code: unix.BPF_JMP | code | unix.BPF_K, K: k},
+		jt:         jt,
+		jf:         jf,
+	})
+}
+
+func (A *bpfAsm) goTo(l label) {
+	A.insns = append(A.insns, bpfInsn{
+		SockFilter: unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JA},
+		jt:         l,
+		ja:         true,
+	})
+}
+
+func (A *bpfAsm) assemble(accept int, reject int) (prog []unix.SockFilter, err error) {
+	target := func(pc int, l label) (uint32, error) {
+		var to int
+		switch l {
+		case next:
+			return 0, nil
+		case labelAccept:
+			to = accept
+		case labelReject:
+			to = reject
+		default:
+			to = A.labels[l]
+		}
+		if to <= pc {
+			return 0, errors.New("filter jumps backwards")
+		}
+		return uint32(to - pc - 1), nil
+	}
+
+	prog = make([]unix.SockFilter, len(A.insns))
+	for pc, in := range A.insns {
+		prog[pc] = in.SockFilter
+
+		jt, err := target(pc, in.jt)
+		if err != nil {
+			return nil, err
+		}
+		if in.ja {
+			prog[pc].K = jt
+			continue
+		}
+		jf, err := target(pc, in.jf)
+		if err != nil {
+			return nil, err
+		}
+		if jt > 0xff || jf > 0xff {
+			return nil, errors.New("filter is too large")
+		}
+		prog[pc].Jt, prog[pc].Jf = uint8(jt), uint8(jf)
+	}
+
+	return prog, nil
+}
+
+// CompileFilter compiles filters into a classic BPF program for packets
+// of the given link type. A packet is accepted when it matches any of the
+// filters, no filters accepts every packet.
+func CompileFilter(link LinkType, filters ...Filter) (prog []unix.SockFilter, err error) {
+	if len(filters) == 0 {
+		return []unix.SockFilter{{Code: unix.BPF_RET | unix.BPF_K, K: filterAccept}}, nil
+	}
+
+	base := uint32(0)
+	if link == LinkEthernet {
+		base = 14
+	}
+
+	A := &bpfAsm{}
+	for _, f := range filters {
+		versions, err := f.versions()
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range versions {
+			fail := A.newLabel()
+			f.compile(A, link, base, v, fail)
+			A.goTo(labelAccept)
+			A.mark(fail)
+		}
+	}
+
+	// the last failure falls through to reject
+	reject := len(A.insns)
+	A.stmt(unix.BPF_RET|unix.BPF_K, 0)
+	accept := len(A.insns)
+	A.stmt(unix.BPF_RET|unix.BPF_K, filterAccept)
+
+	return A.assemble(accept, reject)
+}
+
+func (f *Filter) versions() ([]int, error) {
+	v := f.Version
+	if f.Net.IsValid() {
+		nv := 4
+		if f.Net.Addr().Is6() && !f.Net.Addr().Is4In6() {
+			nv = 6
+		}
+		if v != 0 && v != nv {
+			return nil, errors.New("filter version does not match its network: " + f.Net.String())
+		}
+		v = nv
+	}
+
+	switch v {
+	case 0:
+		return []int{4, 6}, nil
+	case 4, 6:
+		return []int{v}, nil
+	}
+	return nil, errors.New("invalid IP version in filter")
+}
+
+// compile emits the checks of f for IP version v, every check that fails
+// jumps to fail.
+func (f *Filter) compile(A *bpfAsm, link LinkType, base uint32, v int, fail label) {
+	// version
+	if link == LinkEthernet {
+		etherType := uint32(0x0800)
+		if v == 6 {
+			etherType = 0x86dd
+		}
+		A.stmt(unix.BPF_LD|unix.BPF_H|unix.BPF_ABS, 12)
+		A.jump(unix.BPF_JEQ, etherType, next, fail)
+	} else {
+		A.stmt(unix.BPF_LD|unix.BPF_B|unix.BPF_ABS, base)
+		A.stmt(unix.BPF_ALU|unix.BPF_RSH|unix.BPF_K, 4)
+		A.jump(unix.BPF_JEQ, uint32(v), next, fail)
+	}
+
+	// protocol
+	protoOffset := base + 9
+	if v == 6 {
+		protoOffset = base + 6
+	}
+	if f.Protocol != 0 {
+		A.stmt(unix.BPF_LD|unix.BPF_B|unix.BPF_ABS, protoOffset)
+		A.jump(unix.BPF_JEQ, uint32(f.Protocol), next, fail)
+	} else if len(f.Ports) > 0 {
+		ok := A.newLabel()
+		A.stmt(unix.BPF_LD|unix.BPF_B|unix.BPF_ABS, protoOffset)
+		A.jump(unix.BPF_JEQ, syscall.IPPROTO_TCP, ok, next)
+		A.jump(unix.BPF_JEQ, syscall.IPPROTO_UDP, ok, next)
+		A.jump(unix.BPF_JEQ, unix.IPPROTO_SCTP, ok, fail)
+		A.mark(ok)
+	}
+
+	// address
+	if f.Net.IsValid() {
+		src, dst := base+12, base+16
+		if v == 6 {
+			src, dst = base+8, base+24
+		}
+		f.compileNet(A, src, dst, fail)
+	}
+
+	// ports
+	if len(f.Ports) > 0 {
+		if v == 4 {
+			// skip fragments and load the header length into X
+			A.stmt(unix.BPF_LD|unix.BPF_H|unix.BPF_ABS, base+6)
+			A.jump(unix.BPF_JSET, 0x1fff, fail, next)
+			A.stmt(unix.BPF_LDX|unix.BPF_B|unix.BPF_MSH, base)
+		} else {
+			A.stmt(unix.BPF_LDX|unix.BPF_W|unix.BPF_IMM, 40)
+		}
+		f.compilePorts(A, base, fail)
+	}
+}
+
+// compileNet matches f.Net against the address at src, dst or either.
+func (f *Filter) compileNet(A *bpfAsm, src uint32, dst uint32, fail label) {
+	addr := f.Net.Masked().Addr().Unmap().AsSlice()
+	bits := f.Net.Bits()
+	if f.Net.Addr().Is4In6() {
+		bits -= 96
+	}
+
+	match := func(offset uint32, miss label) {
+		for i := 0; i < len(addr); i += 4 {
+			maskBits := bits - i*8
+			if maskBits <= 0 {
+				break
+			}
+			mask := uint32(0xffffffff)
+			if maskBits < 32 {
+				mask <<= 32 - maskBits
+			}
+			A.stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, offset+uint32(i))
+			if mask != 0xffffffff {
+				A.stmt(unix.BPF_ALU|unix.BPF_AND|unix.BPF_K, mask)
+			}
+			A.jump(unix.BPF_JEQ, binary.BigEndian.Uint32(addr[i:]), next, miss)
+		}
+	}
+
+	switch f.Direction {
+	case DirSrc:
+		match(src, fail)
+	case DirDst:
+		match(dst, fail)
+	default:
+		tryDst, ok := A.newLabel(), A.newLabel()
+		match(src, tryDst)
+		A.goTo(ok)
+		A.mark(tryDst)
+		match(dst, fail)
+		A.mark(ok)
+	}
+}
+
+// compilePorts matches f.Ports against the transport header at X.
+func (f *Filter) compilePorts(A *bpfAsm, base uint32, fail label) {
+	ok := A.newLabel()
+	match := func(offset uint32, miss label) {
+		A.stmt(unix.BPF_LD|unix.BPF_H|unix.BPF_IND, base+offset)
+		for i, port := range f.Ports {
+			if i == len(f.Ports)-1 {
+				A.jump(unix.BPF_JEQ, uint32(port), ok, miss)
+			} else {
+				A.jump(unix.BPF_JEQ, uint32(port), ok, next)
+			}
+		}
+	}
+
+	switch f.Direction {
+	case DirSrc:
+		match(0, fail)
+	case DirDst:
+		match(2, fail)
+	default:
+		tryDst := A.newLabel()
+		match(0, tryDst)
+		A.mark(tryDst)
+		match(2, fail)
+	}
+	A.mark(ok)
+}
+
+// AttachFilter attaches a classic BPF program to the socket, packets it
+// rejects are dropped by the kernel. Use CompileFilter with the
+// LinkType of the socket to build one. The kernel does not filter what a
+// TUN device queues for reading, to sniff a TUN device put a RawSocket in
+// ring mode on it and attach a LinkIP filter there.
+func (r *RawSocket) AttachFilter(prog []unix.SockFilter) (err error) {
+	if len(prog) == 0 {
+		return errors.New("filter program is empty")
+	}
+	return unix.SetsockoptSockFprog(r.fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &unix.SockFprog{
+		Len:    uint16(len(prog)),
+		Filter: &prog[0],
+	})
+}
+
+// DetachFilter removes the filter from the socket.
+func (r *RawSocket) DetachFilter() (err error) {
+	return syscall.SetsockoptInt(r.fd, unix.SOL_SOCKET, unix.SO_DETACH_FILTER, 0)
+}
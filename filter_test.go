@@ -0,0 +1,311 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// runFilter runs a classic BPF program on pkt the way the kernel does, a
+// load past the end of the packet rejects it. Only the instructions
+// CompileFilter emits are supported.
+func runFilter(t *testing.T, prog []unix.SockFilter, pkt []byte) uint32 {
+	t.Helper()
+
+	var A, X uint32
+	load := func(off uint32, size uint16) (v uint32, ok bool) {
+		n := map[uint16]uint64{unix.BPF_B: 1, unix.BPF_H: 2, unix.BPF_W: 4}[size]
+		if uint64(off)+n > uint64(len(pkt)) {
+			return 0, false
+		}
+		switch size {
+		case unix.BPF_B:
+			return uint32(pkt[off]), true
+		case unix.BPF_H:
+			return uint32(binary.BigEndian.Uint16(pkt[off:])), true
+		}
+		return binary.BigEndian.Uint32(pkt[off:]), true
+	}
+
+	for pc := 0; pc < len(prog); pc++ {
+		in := prog[pc]
+		size, mode, op := in.Code&0x18, in.Code&0xe0, in.Code&0xf0
+		ok := true
+
+		switch in.Code & 0x07 {
+		case unix.BPF_LD:
+			switch mode {
+			case unix.BPF_ABS:
+				A, ok = load(in.K, size)
+			case unix.BPF_IND:
+				A, ok = load(X+in.K, size)
+			default:
+				t.Fatalf("pc %d: unsupported load %#x", pc, in.Code)
+			}
+		case unix.BPF_LDX:
+			switch mode {
+			case unix.BPF_MSH:
+				var b uint32
+				b, ok = load(in.K, unix.BPF_B)
+				X = (b & 0x0f) * 4
+			case unix.BPF_IMM:
+				X = in.K
+			default:
+				t.Fatalf("pc %d: unsupported load %#x", pc, in.Code)
+			}
+		case unix.BPF_ALU:
+			switch op {
+			case unix.BPF_RSH:
+				A >>= in.K
+			case unix.BPF_AND:
+				A &= in.K
+			default:
+				t.Fatalf("pc %d: unsupported alu op %#x", pc, in.Code)
+			}
+		case unix.BPF_JMP:
+			var cond bool
+			switch op {
+			case unix.BPF_JA:
+				pc += int(in.K)
+				continue
+			case unix.BPF_JEQ:
+				cond = A == in.K
+			case unix.BPF_JSET:
+				cond = A&in.K != 0
+			default:
+				t.Fatalf("pc %d: unsupported jump %#x", pc, in.Code)
+			}
+			if cond {
+				pc += int(in.Jt)
+			} else {
+				pc += int(in.Jf)
+			}
+		case unix.BPF_RET:
+			return in.K
+		default:
+			t.Fatalf("pc %d: unsupported instruction %#x", pc, in.Code)
+		}
+
+		if !ok {
+			return 0
+		}
+	}
+
+	t.Fatal("program ran past its end")
+	return 0
+}
+
+// ipPacket builds a packet from 10.0.0.1 to 10.0.0.2, or fd00::1 to
+// fd00::2, with a transport header from port 1000 to port 2000.
+func ipPacket(version int, proto uint8) []byte {
+	iphLen := 20
+	if version == 6 {
+		iphLen = 40
+	}
+	pkt := make([]byte, iphLen+40)
+	if version == 4 {
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		pkt[8], pkt[9] = 64, proto
+		copy(pkt[12:], []byte{10, 0, 0, 1, 10, 0, 0, 2})
+	} else {
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)-40))
+		pkt[6], pkt[7] = proto, 64
+		pkt[8], pkt[23] = 0xfd, 1
+		pkt[24], pkt[39] = 0xfd, 2
+	}
+	binary.BigEndian.PutUint16(pkt[iphLen:], 1000)
+	binary.BigEndian.PutUint16(pkt[iphLen+2:], 2000)
+	return pkt
+}
+
+func ether(etherType uint16, pkt []byte) []byte {
+	frame := make([]byte, 14, 14+len(pkt))
+	binary.BigEndian.PutUint16(frame[12:], etherType)
+	return append(frame, pkt...)
+}
+
+func TestCompileFilter(t *testing.T) {
+	udp4 := ipPacket(4, unix.IPPROTO_UDP)
+	tcp4 := ipPacket(4, unix.IPPROTO_TCP)
+	udp6 := ipPacket(6, unix.IPPROTO_UDP)
+	tcp6 := ipPacket(6, unix.IPPROTO_TCP)
+
+	icmp4 := append([]byte(nil), udp4...)
+	icmp4[9] = unix.IPPROTO_ICMP
+
+	// a later fragment carries no transport header
+	frag4 := append([]byte(nil), udp4...)
+	binary.BigEndian.PutUint16(frag4[6:], 100)
+
+	// four bytes of NOP options move the transport header
+	opts4 := append(append(append([]byte(nil), udp4[:20]...), 1, 1, 1, 1), udp4[20:]...)
+	opts4[0] = 0x46
+	binary.BigEndian.PutUint16(opts4[2:], uint16(len(opts4)))
+
+	vlan4 := append([]byte{0, 1, 0x08, 0}, udp4...)
+
+	type match struct {
+		pkt    []byte
+		accept bool
+	}
+	tests := []struct {
+		name    string
+		link    LinkType
+		filters []Filter
+		matches []match
+	}{
+		{
+			name:    "no filters",
+			matches: []match{{udp4, true}, {tcp6, true}},
+		},
+		{
+			name:    "version",
+			filters: []Filter{{Version: 6}},
+			matches: []match{{udp4, false}, {udp6, true}, {tcp6, true}},
+		},
+		{
+			name:    "protocol",
+			filters: []Filter{{Protocol: unix.IPPROTO_UDP}},
+			matches: []match{{udp4, true}, {udp6, true}, {tcp4, false}, {tcp6, false}},
+		},
+		{
+			name:    "v4 net",
+			filters: []Filter{{Net: netip.MustParsePrefix("10.0.0.0/24")}},
+			matches: []match{{udp4, true}, {tcp4, true}, {udp6, false}},
+		},
+		{
+			name:    "v4 host source",
+			filters: []Filter{{Net: netip.MustParsePrefix("10.0.0.2/32"), Direction: DirSrc}},
+			matches: []match{{udp4, false}},
+		},
+		{
+			name:    "v4 host destination",
+			filters: []Filter{{Net: netip.MustParsePrefix("10.0.0.2/32"), Direction: DirDst}},
+			matches: []match{{udp4, true}},
+		},
+		{
+			name:    "v4 other net",
+			filters: []Filter{{Net: netip.MustParsePrefix("10.1.0.0/16")}},
+			matches: []match{{udp4, false}},
+		},
+		{
+			name:    "v6 net",
+			filters: []Filter{{Net: netip.MustParsePrefix("fd00::/16")}},
+			matches: []match{{udp6, true}, {tcp6, true}, {udp4, false}},
+		},
+		{
+			name:    "v6 host source",
+			filters: []Filter{{Net: netip.MustParsePrefix("fd00::1/128"), Direction: DirSrc}},
+			matches: []match{{udp6, true}},
+		},
+		{
+			name:    "v6 host destination",
+			filters: []Filter{{Net: netip.MustParsePrefix("fd00::1/128"), Direction: DirDst}},
+			matches: []match{{udp6, false}},
+		},
+		{
+			name:    "port either way",
+			filters: []Filter{{Ports: []uint16{2000}}},
+			matches: []match{{udp4, true}, {tcp4, true}, {udp6, true}, {tcp6, true}, {icmp4, false}, {frag4, false}},
+		},
+		{
+			name:    "port after ip options",
+			filters: []Filter{{Ports: []uint16{2000}, Direction: DirDst}},
+			matches: []match{{opts4, true}},
+		},
+		{
+			name:    "source port",
+			filters: []Filter{{Ports: []uint16{2000}, Direction: DirSrc}},
+			matches: []match{{udp4, false}, {udp6, false}},
+		},
+		{
+			name:    "one of several ports",
+			filters: []Filter{{Ports: []uint16{5, 6, 1000}, Direction: DirSrc}},
+			matches: []match{{udp4, true}, {tcp6, true}},
+		},
+		{
+			name:    "other port",
+			filters: []Filter{{Ports: []uint16{3000}}},
+			matches: []match{{udp4, false}, {tcp6, false}},
+		},
+		{
+			name:    "every field",
+			filters: []Filter{{Protocol: unix.IPPROTO_TCP, Net: netip.MustParsePrefix("10.0.0.1/32"), Ports: []uint16{2000}, Direction: DirAny}},
+			matches: []match{{tcp4, true}, {udp4, false}, {tcp6, false}},
+		},
+		{
+			name: "any filter",
+			filters: []Filter{
+				{Protocol: unix.IPPROTO_TCP},
+				{Version: 4, Ports: []uint16{2000}},
+			},
+			matches: []match{{tcp4, true}, {tcp6, true}, {udp4, true}, {udp6, false}, {icmp4, false}},
+		},
+		{
+			name:    "ethernet",
+			link:    LinkEthernet,
+			filters: []Filter{{Ports: []uint16{2000}}},
+			matches: []match{
+				{ether(0x0800, udp4), true},
+				{ether(0x86dd, tcp6), true},
+				{ether(0x8100, vlan4), false},
+				{ether(0x0800, icmp4), false},
+			},
+		},
+		{
+			name:    "ethernet net",
+			link:    LinkEthernet,
+			filters: []Filter{{Net: netip.MustParsePrefix("fd00::2/128"), Direction: DirDst}},
+			matches: []match{{ether(0x86dd, udp6), true}, {ether(0x0800, udp4), false}},
+		},
+		{
+			name:    "truncated packet",
+			filters: []Filter{{Ports: []uint16{2000}}},
+			matches: []match{{udp4[:21], false}, {udp6[:41], false}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := CompileFilter(tt.link, tt.filters...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, m := range tt.matches {
+				accepted := runFilter(t, prog, m.pkt) != 0
+				if accepted != m.accept {
+					t.Errorf("packet %d: accepted %v, want %v", i, accepted, m.accept)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileFilterErrors(t *testing.T) {
+	tooMany := make([]uint16, 300)
+	for i := range tooMany {
+		tooMany[i] = uint16(i + 1)
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+	}{
+		{"version does not match net", Filter{Version: 6, Net: netip.MustParsePrefix("10.0.0.0/8")}},
+		{"invalid version", Filter{Version: 5}},
+		{"jump too far", Filter{Ports: tooMany}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := CompileFilter(LinkIP, tt.filter); err == nil {
+				t.Fatal("CompileFilter did not fail")
+			}
+		})
+	}
+}
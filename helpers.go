@@ -51,3 +51,39 @@ func (sa *SockaddrInet4) sockaddr() (unsafe.Pointer, uint32, error) {
 	sa.raw.Addr = sa.Addr
 	return unsafe.Pointer(&sa.raw), 0x10, nil
 }
+
+// checksumNoFold adds b to the running ones' complement sum.
+func checksumNoFold(b []byte, initial uint64) uint64 {
+	sum := initial
+	for len(b) >= 2 {
+		sum += uint64(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint64(b[0]) << 8
+	}
+	return sum
+}
+
+// checksumFold folds a running sum into 16 bits without complementing it.
+func checksumFold(sum uint64) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
+// Checksum returns the internet checksum of b, as used in IPv4, TCP,
+// UDP and ICMP headers.
+func Checksum(b []byte, initial uint64) uint16 {
+	return ^checksumFold(checksumNoFold(b, initial))
+}
+
+// pseudoHeaderSum returns the unfolded sum of the TCP/UDP pseudo header.
+func pseudoHeaderSum(proto uint8, src, dst []byte, length uint16) uint64 {
+	sum := checksumNoFold(src, 0)
+	sum = checksumNoFold(dst, sum)
+	sum += uint64(proto)
+	sum += uint64(length)
+	return sum
+}
@@ -0,0 +1,396 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+type JournalKind string
+
+const (
+	JournalLink    JournalKind = "link"
+	JournalAddress JournalKind = "address"
+	JournalRoute   JournalKind = "route"
+	JournalRule    JournalKind = "rule"
+)
+
+// JournalEntry is a single change to the host. Entries are written before
+// the change is made and a matching entry with Revert set is written once
+// the change has been undone by the package. NetNS names the namespace
+// of the change, changes in a namespace without a name are not journaled.
+type JournalEntry struct {
+	Kind       JournalKind `json:"kind"`
+	Revert     bool        `json:"revert,omitempty"`
+	Link       string      `json:"link,omitempty"`
+	NetNS      string      `json:"netns,omitempty"`
+	Persistent bool        `json:"persistent,omitempty"`
+	Address    *Address    `json:"address,omitempty"`
+	Route      *Route      `json:"route,omitempty"`
+	Rule       *Rule       `json:"rule,omitempty"`
+	// Replaced is the route a RouteReplace replaced, Recover puts it back
+	// instead of deleting Route.
+	Replaced *Route `json:"replaced,omitempty"`
+}
+
+func (e JournalEntry) key() string {
+	switch e.Kind {
+	case JournalAddress:
+		return fmt.Sprintf("address %s %s %s", e.NetNS, e.Link, e.Address.Prefix)
+	case JournalRoute:
+		return fmt.Sprintf("route %s %s", e.NetNS, routeKey(*e.Route))
+	case JournalRule:
+		b, _ := json.Marshal(e.Rule)
+		return fmt.Sprintf("rule %s %s", e.NetNS, b)
+	default:
+		return fmt.Sprintf("%s %s %s", e.Kind, e.NetNS, e.Link)
+	}
+}
+
+// Journal is an append only file of the changes the package has made to
+// the host, it is used by Recover to clean up after a crash.
+type Journal struct {
+	Path string
+
+	mu      sync.Mutex
+	file    *os.File
+	applied map[string]JournalEntry
+	order   []string
+}
+
+var (
+	journalMu sync.Mutex
+	journal   *Journal
+)
+
+// EnableJournal starts recording every change the package makes to the
+// host in the file at path. Entries already in the file are kept, call
+// Recover first to undo them.
+func EnableJournal(path string) (err error) {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+
+	if journal != nil {
+		return errors.New("journal is already enabled: " + journal.Path)
+	}
+
+	entries, err := readJournal(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	j := &Journal{
+		Path:    path,
+		file:    file,
+		applied: make(map[string]JournalEntry),
+	}
+	for _, e := range entries {
+		j.replay(e)
+	}
+
+	journal = j
+	return nil
+}
+
+// DisableJournal stops recording changes, the file is left as it is.
+func DisableJournal() (err error) {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+
+	if journal == nil {
+		return nil
+	}
+	err = journal.file.Close()
+	journal = nil
+	return
+}
+
+// Recover undoes every change in the journal at path that was not undone
+// before, newest first. It is meant to be called on startup, before
+// EnableJournal, to clean up after a previous run that crashed. Changes
+// that could not be undone are kept in the journal and returned in the
+// error.
+func Recover(path string) (undone []JournalEntry, err error) {
+	journalMu.Lock()
+	if journal != nil && journal.Path == path {
+		journalMu.Unlock()
+		return nil, errors.New("can not recover a journal that is in use")
+	}
+	journalMu.Unlock()
+
+	entries, err := readJournal(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	j := &Journal{applied: make(map[string]JournalEntry)}
+	for _, e := range entries {
+		j.replay(e)
+	}
+
+	var remaining []JournalEntry
+	var errs []error
+	for i := len(j.order) - 1; i >= 0; i-- {
+		e, ok := j.applied[j.order[i]]
+		if !ok {
+			continue
+		}
+		delete(j.applied, j.order[i])
+
+		if uerr := undoEntry(e); uerr != nil && !errors.Is(uerr, ErrNotFound) {
+			errs = append(errs, fmt.Errorf("%s: %w", e.key(), uerr))
+			remaining = append([]JournalEntry{e}, remaining...)
+			continue
+		}
+		undone = append(undone, e)
+	}
+
+	if err = writeJournal(path, remaining); err != nil {
+		errs = append(errs, err)
+	}
+
+	return undone, errors.Join(errs...)
+}
+
+func undoEntry(e JournalEntry) (err error) {
+	IF := &Interface{Name: e.Link}
+	if e.NetNS != "" {
+		ns, err := OpenNetNS(e.NetNS)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		defer ns.Close()
+		IF.NetNS = ns
+	}
+
+	switch e.Kind {
+	case JournalLink:
+		return IF.Syscall_Delete()
+	case JournalAddress:
+		return IF.DelAddress(*e.Address)
+	case JournalRoute:
+		return IF.do(func() error {
+			if e.Replaced != nil {
+				return RouteReplace(*e.Replaced)
+			}
+			return RouteDel(*e.Route)
+		})
+	case JournalRule:
+		return IF.do(func() error {
+			return RuleDel(*e.Rule)
+		})
+	}
+
+	return errors.New("unknown journal entry: " + string(e.Kind))
+}
+
+// replay applies an entry read from disk to the in memory state.
+func (J *Journal) replay(e JournalEntry) {
+	key := e.key()
+	if !e.Revert {
+		if _, ok := J.applied[key]; !ok {
+			J.order = append(J.order, key)
+		}
+		J.applied[key] = e
+		return
+	}
+
+	delete(J.applied, key)
+	if e.Kind == JournalLink {
+		// everything on the link went away with it
+		for k, a := range J.applied {
+			if a.Link == e.Link && a.NetNS == e.NetNS && a.Kind != JournalRoute && a.Kind != JournalRule {
+				delete(J.applied, k)
+			}
+		}
+	}
+}
+
+// write records e, written is false when the journal already was in the
+// state e describes.
+func (J *Journal) write(e JournalEntry) (written bool, err error) {
+	J.mu.Lock()
+	defer J.mu.Unlock()
+
+	key := e.key()
+	updated := false
+	if old, ok := J.applied[key]; ok == !e.Revert {
+		if !ok || e.Kind != JournalRoute || *old.Route == *e.Route {
+			return false, nil
+		}
+		// a route replaced again still restores the route it first replaced
+		e.Replaced = old.Replaced
+		updated = true
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return false, err
+	}
+	if _, err = J.file.Write(append(b, '\n')); err != nil {
+		return false, err
+	}
+	if err = J.file.Sync(); err != nil {
+		return false, err
+	}
+
+	J.replay(e)
+
+	// nothing left to undo, start over with an empty file
+	if len(J.applied) == 0 {
+		J.order = nil
+		if err = J.file.Truncate(0); err != nil {
+			return !updated, err
+		}
+	}
+
+	return !updated, nil
+}
+
+// journalApply records a change before it is made, fresh is false when
+// an earlier change already recorded it.
+func journalApply(e JournalEntry) (fresh bool, err error) {
+	journalMu.Lock()
+	j := journal
+	journalMu.Unlock()
+
+	if j == nil {
+		return false, nil
+	}
+	e.Revert = false
+	return j.write(e)
+}
+
+// journalEnabled reports whether changes are being journaled.
+func journalEnabled() bool {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	return journal != nil
+}
+
+// netJournalEntry returns a journal entry for a route or rule changed in
+// the namespace of the calling thread. Changes in a namespace Recover can
+// not open again are not journaled.
+func netJournalEntry(kind JournalKind) (e JournalEntry, ok bool) {
+	e.Kind = kind
+	if !journalEnabled() {
+		return e, false
+	}
+	e.NetNS, ok = threadNetNS()
+	return e, ok
+}
+
+// journalChange records e and makes the change with fn. When fn fails the
+// entry is dropped again, unless an earlier change recorded it.
+func journalChange(e JournalEntry, fn func() error) (err error) {
+	fresh, err := journalApply(e)
+	if err != nil {
+		return err
+	}
+	if err = fn(); err != nil && fresh {
+		if rerr := journalRevert(e); rerr != nil {
+			return errors.Join(err, rerr)
+		}
+	}
+	return err
+}
+
+// journalRevert records that a change has been undone.
+func journalRevert(e JournalEntry) error {
+	journalMu.Lock()
+	j := journal
+	journalMu.Unlock()
+
+	if j == nil {
+		return nil
+	}
+	e.Revert = true
+	_, err := j.write(e)
+	return err
+}
+
+func readJournal(path string) (entries []JournalEntry, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e JournalEntry
+		// a crash in the middle of a write leaves a partial last line
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, scanner.Err()
+}
+
+func writeJournal(path string, entries []JournalEntry) (err error) {
+	if len(entries) == 0 {
+		if err = os.Remove(path); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	for _, e := range entries {
+		b, err := json.Marshal(e)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		w.Write(append(b, '\n'))
+	}
+	if err = w.Flush(); err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// journalEntry returns a journal entry for the interface. Interfaces in
+// a namespace without a name can not be found again by Recover, so they
+// are not journaled.
+func (IF *Interface) journalEntry(kind JournalKind) (e JournalEntry, ok bool) {
+	e = JournalEntry{Kind: kind, Link: IF.Name}
+	if IF.NetNS != nil {
+		if IF.NetNS.Name == "" {
+			return e, false
+		}
+		e.NetNS = IF.NetNS.Name
+	}
+	return e, true
+}
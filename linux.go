@@ -3,38 +3,23 @@
 package tunnels
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
-	"os/exec"
 	"syscall"
+	"time"
 	"unsafe"
-)
 
-type syscallAddAddrV4 struct {
-	Name [16]byte
-	syscall.RawSockaddrInet4
-}
-type syscallAddAddrV6 struct {
-	Name [16]byte
-	syscall.RawSockaddrInet6
-}
+	"golang.org/x/sys/unix"
+)
 
-type syscallChangeMTU struct {
+type syscallSetHWAddr struct {
 	Name [16]byte
-	MTU  int32
-}
-
-type syscallChangeTXQueueLen struct {
-	Name       [16]byte
-	TxQueueLen int32
-}
-
-type syscallSetFlags struct {
-	Name  [16]byte
-	Flags int16
+	syscall.RawSockaddr
+	pad [0x28 - 0x10 - 0x10]byte
 }
 
 // TODO
@@ -46,6 +31,9 @@ type Interface struct {
 	IPv4Address string
 	IPv6Address string
 	NetMask     string
+	IPv6Flags   uint32
+	IPv6Scope   uint8
+	DADTimeout  time.Duration
 	TxQueuelen  int32
 	MTU         int32
 	User        uint
@@ -54,168 +42,131 @@ type Interface struct {
 	Persistent  bool
 	TunnelFile  string
 
+	// TAP creates a layer-2 device that reads and writes ethernet
+	// frames instead of IP packets.
+	TAP             bool
+	HardwareAddress string
+
+	// VnetHdr prefixes every packet with a virtio_net_hdr and enables
+	// the offloads in Offload, see ReadPackets and WritePackets.
+	VnetHdr bool
+	Offload int
+
 	RWC io.ReadWriteCloser
 	FD  uintptr
+
+	// Queues is populated by CreateQueues on multiqueue interfaces.
+	Queues []*Queue
+
+	// NetNS is the network namespace the interface lives in, nil means
+	// the namespace of the process. See SetNetNS.
+	NetNS *NetNS
+
+	// Pool provides the buffers for ReceivePacket and AllocateSendPacket,
+	// a pool sized for the MTU is created when it is nil.
+	Pool *PacketPool
+
+	// IOUring makes ReadBatch use io_uring with IOUringEntries reads
+	// posted, the normal read path is used when io_uring is not available
+	// or VnetHdr is set.
+	IOUring        bool
+	IOUringEntries int
+
+	// CPUs are the CPUs RunIOThreads pins the thread of each queue to,
+	// queue i runs on CPUs[i%len(CPUs)]. When empty queue i runs on the
+	// i-th CPU the process is allowed to use.
+	CPUs []int
+
+	vnetReadBuf  []byte
+	vnetWriteBuf []byte
+	vnetPending  []byte
+	counters     counters
+	packets      packetTracker
+	uring        *Uring
+	threads      ioThreads
 }
 
 func (IF *Interface) Syscall_TXQueuelen() (err error) {
-	var ifr syscallChangeTXQueueLen
-	copy(ifr.Name[:], []byte(IF.Name))
-	ifr.TxQueueLen = IF.TxQueuelen
-
-	if err = socketCtl(
-		syscall.SIOCSIFTXQLEN,
-		uintptr(unsafe.Pointer(&ifr)),
-	); err != nil {
-		return
-	}
-
-	return
+	return IF.setLink("txqueuelen", 0, 0, func(m *netlinkMessage) {
+		m.addUint32(unix.IFLA_TXQLEN, uint32(IF.TxQueuelen))
+	})
 }
 
 func (IF *Interface) Syscall_MTU() (err error) {
-	var ifr syscallChangeMTU
-	copy(ifr.Name[:], []byte(IF.Name))
-	ifr.MTU = IF.MTU
-
-	if err = socketCtl(
-		syscall.SIOCSIFMTU,
-		uintptr(unsafe.Pointer(&ifr)),
-	); err != nil {
-		return
-	}
-
-	return
+	return IF.setLink("mtu", 0, 0, func(m *netlinkMessage) {
+		m.addUint32(unix.IFLA_MTU, uint32(IF.MTU))
+	})
 }
 
+// Syscall_NetMask changes the prefix length of IF.IPv4Address to match
+// IF.NetMask, the address is re-added with the new prefix.
 func (IF *Interface) Syscall_NetMask() (err error) {
-	var ifr syscallAddAddrV4
-	ifr.Port = 0
-	ifr.Family = syscall.AF_INET
+	prefix, err := IF.ipv4Prefix()
+	if err != nil {
+		return err
+	}
 
-	copy(ifr.Name[:], []byte(IF.Name))
-	copy(ifr.Addr[:], net.ParseIP(IF.NetMask).To4())
+	addrs, err := IF.ListAddresses()
+	if err != nil {
+		return err
+	}
 
-	if err = socketCtl(
-		syscall.SIOCSIFNETMASK,
-		uintptr(unsafe.Pointer(&ifr)),
-	); err != nil {
-		return
+	for _, a := range addrs {
+		if a.Prefix.Addr() == prefix.Addr() && a.Prefix.Bits() != prefix.Bits() {
+			if err = IF.DelAddress(a); err != nil {
+				return err
+			}
+		}
 	}
 
-	return
+	return IF.ReplaceAddress(Address{Prefix: prefix})
 }
 
-// func (IF *Interface) Syscall_Addrv6() (err error) {
-// 	iface, err := net.InterfaceByName(IF.Name)
-// 	if err != nil {
-// 		return err
-// 	}
-//
-// 	var ifr syscallAddAddrV6
-// 	ifr.Port = 0
-// 	ifr.Family = syscall.AF_INET6
-// 	ifr.Flowinfo = uint32(0)
-// 	ifr.Scope_id = uint32(iface.Index)
-//
-// 	copy(ifr.Name[:], []byte(IF.Name))
-// 	copy(ifr.Addr[:], net.ParseIP(IF.IPv6Address).To16())
-// 	fmt.Println(ifr)
-//
-// 	if err = socketCtlv6(
-// 		syscall.SIOCSIFADDR,
-// 		uintptr(unsafe.Pointer(&ifr)),
-// 	); err != nil {
-// 		return
-// 	}
-//
-// 	return
-// }
-
-// func (IF *Interface) IPv6_ADDR() (err error) {
-// 	out, err := exec.Command(
-// 		"ip",
-// 		"-6",
-// 		"addr",
-// 		"add",
-// 		IF.IPv6Address,
-// 		"dev",
-// 		IF.Name,
-// 	).CombinedOutput()
-// 	if err != nil {
-// 		return errors.New(err.Error() + "---" + string(out))
-// 	}
-// 	return
-// }
-
+// Syscall_Addr assigns IF.IPv4Address to the interface, using IF.NetMask
+// for the prefix length if it is set.
 func (IF *Interface) Syscall_Addr() (err error) {
-	var ifr syscallAddAddrV4
-	ifr.Port = 0
-	ifr.Family = syscall.AF_INET
-
-	copy(ifr.Name[:], []byte(IF.Name))
-	copy(ifr.Addr[:], net.ParseIP(IF.IPv4Address).To4())
-
-	if err = socketCtl(
-		syscall.SIOCSIFADDR,
-		uintptr(unsafe.Pointer(&ifr)),
-	); err != nil {
-		return
+	prefix, err := IF.ipv4Prefix()
+	if err != nil {
+		return err
 	}
 
-	return
+	return IF.ReplaceAddress(Address{Prefix: prefix})
 }
 
 func (IF *Interface) Syscall_DOWN() (err error) {
-	var ifr syscallSetFlags
-
-	copy(ifr.Name[:], []byte(IF.Name))
-	ifr.Flags |= 0x0
-
-	if err = socketCtl(
-		syscall.SIOCSIFFLAGS,
-		uintptr(unsafe.Pointer(&ifr)),
-	); err != nil {
-		return
-	}
-
-	return
+	return IF.setLink("down", 0, syscall.IFF_UP, nil)
 }
 
 func (IF *Interface) Syscall_Delete() (err error) {
-	var ifr syscallSetFlags
-	DOR := 1 << 17
+	err = IF.do(func() error {
+		index, err := linkIndex(IF.Name)
+		if err != nil {
+			return err
+		}
 
-	copy(ifr.Name[:], []byte(IF.Name))
-	ifr.Flags |= 0x0
-	ifr.Flags = int16(DOR)
+		ifi := unix.IfInfomsg{
+			Family: syscall.AF_UNSPEC,
+			Index:  int32(index),
+		}
 
-	if err = socketCtl(
-		syscall.SIOCSIFFLAGS,
-		uintptr(unsafe.Pointer(&ifr)),
-	); err != nil {
-		return
+		_, err = netlinkExecute(
+			"dellink",
+			newNetlinkMessage(unix.RTM_DELLINK, 0, unsafe.Pointer(&ifi), unix.SizeofIfInfomsg),
+		)
+		return err
+	})
+	if err != nil {
+		return err
 	}
 
-	_ = exec.Command("ip", "link", "delete", IF.Name).Run()
-
-	return
+	if e, ok := IF.journalEntry(JournalLink); ok {
+		return journalRevert(e)
+	}
+	return nil
 }
 
 func (IF *Interface) Syscall_UP() (err error) {
-	var ifr syscallSetFlags
-
-	copy(ifr.Name[:], []byte(IF.Name))
-	ifr.Flags |= 0x1
-
-	if err = socketCtl(
-		syscall.SIOCSIFFLAGS,
-		uintptr(unsafe.Pointer(&ifr)),
-	); err != nil {
-		return
-	}
-
-	return
+	return IF.setLink("up", syscall.IFF_UP, syscall.IFF_UP, nil)
 }
 
 //
@@ -284,32 +235,107 @@ type syscallCreateIF struct {
 	pad   [0x28 - 0x10 - 2]byte
 }
 
-func (IF *Interface) Create() (err error) {
+// open opens a new file descriptor on the tunnel file and binds it to
+// the interface, creating the interface if it does not exist yet. When
+// IF.NetNS is set the interface is created inside that namespace.
+func (IF *Interface) open() (fd int, err error) {
+	err = IF.do(func() (err error) {
+		fd, err = IF.openInNS()
+		return err
+	})
+	return
+}
+
+func (IF *Interface) openInNS() (fd int, err error) {
 	if IF.TunnelFile == "" {
 		IF.TunnelFile = "/dev/net/tun"
-		// IF.TunnelFile = "/dev/net/tun"
 	}
 
-	fd, err := syscall.Open(IF.TunnelFile, os.O_RDWR|syscall.O_NONBLOCK, 0)
+	fd, err = syscall.Open(IF.TunnelFile, os.O_RDWR|syscall.O_NONBLOCK, 0)
 	if err != nil {
-		return err
+		return -1, err
 	}
 
-	IF.FD = uintptr(fd)
-
 	var flags uint16 = 0x1000
-	flags |= 0x0001
+	if IF.TAP {
+		flags |= 0x0002 // TAP FLAG
+	} else {
+		flags |= 0x0001
+	}
 	if IF.Multiqueue {
 		flags |= 0x0100 // MULTIQUEUE FLAG
 	}
+	if IF.VnetHdr {
+		flags |= 0x4000 // VNET HEADER FLAG
+	}
 
 	var req syscallCreateIF
 	req.Flags = flags
 	copy(req.Name[:], []byte(IF.Name))
 
-	if err = tunnelCtl(IF.FD, syscall.TUNSETIFF, uintptr(unsafe.Pointer(&req))); err != nil {
+	if err = tunnelCtl(uintptr(fd), syscall.TUNSETIFF, uintptr(unsafe.Pointer(&req))); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+
+	// the kernel picks a name when none was given
+	if IF.Name == "" {
+		IF.Name = unix.ByteSliceToString(req.Name[:])
+	}
+
+	return fd, nil
+}
+
+// linkExists reports whether the interface is already there, so that
+// open attaches to it instead of creating it.
+func (IF *Interface) linkExists() (exists bool, err error) {
+	err = IF.do(func() error {
+		_, err := linkIndex(IF.Name)
 		return err
+	})
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
 	}
+	return err == nil, err
+}
+
+func (IF *Interface) Create() (err error) {
+	var fd int
+	open := func() (err error) {
+		fd, err = IF.open()
+		return err
+	}
+
+	// only an interface created here is journaled, one that is attached
+	// to belongs to someone else
+	e, created := IF.journalEntry(JournalLink)
+	named := IF.Name != ""
+	if created && named {
+		exists, lerr := IF.linkExists()
+		created = lerr == nil && !exists
+	}
+	switch {
+	case created && named:
+		e.Persistent = IF.Persistent
+		err = journalChange(e, open)
+	case created:
+		// the name is only known once the kernel picked it, the interface
+		// is not persistent yet so a crash before the entry is written
+		// still removes it
+		if err = open(); err == nil {
+			e.Link, e.Persistent = IF.Name, IF.Persistent
+			if _, err = journalApply(e); err != nil {
+				syscall.Close(fd)
+			}
+		}
+	default:
+		err = open()
+	}
+	if err != nil {
+		return err
+	}
+
+	IF.FD = uintptr(fd)
 
 	if IF.User != 0 {
 		if err = tunnelCtl(IF.FD, syscall.TUNSETOWNER, uintptr(IF.User)); err != nil {
@@ -329,28 +355,219 @@ func (IF *Interface) Create() (err error) {
 		}
 	}
 
-	IF.RWC = os.NewFile(IF.FD, "tun_"+IF.Name)
+	if IF.TAP && IF.HardwareAddress != "" {
+		if err = IF.Syscall_HWAddr(); err != nil {
+			return err
+		}
+	}
+
+	if IF.VnetHdr {
+		if err = IF.Syscall_Offload(); err != nil {
+			return err
+		}
+	}
+
+	IF.RWC = IF.newTunFile(IF.FD, "tun_"+IF.Name)
+
+	if IF.IOUring && !IF.VnetHdr {
+		IF.uring, err = NewUring(int(IF.FD), IF.IOUringEntries, IF.packetPool().Size())
+		if errors.Is(err, ErrUringUnavailable) {
+			err = nil
+		}
+	}
 	return
 }
 
-func socketCtlv6(request uintptr, argp uintptr) error {
-	fd, err := syscall.Socket(
-		syscall.AF_INET6,
-		syscall.SOCK_DGRAM,
-		syscall.IPPROTO_IP,
-	)
-	defer syscall.Close(fd)
+// UsingIOUring reports whether ReadBatch reads through io_uring.
+func (IF *Interface) UsingIOUring() bool {
+	return IF.uring != nil
+}
+
+// TunFile is the io.ReadWriteCloser used for Interface.RWC and Queue.RWC,
+// it counts packets and errors for Interface.Stats.
+//
+// The descriptor is non-blocking and registered with the runtime poller,
+// Read and Write park the goroutine instead of a thread. SetDeadline,
+// SetReadDeadline and SetWriteDeadline work as on a net.Conn and Close
+// unblocks every pending Read and Write with os.ErrClosed.
+type TunFile struct {
+	*os.File
+
+	counters *counters
+	limit    int
+}
+
+func (IF *Interface) newTunFile(fd uintptr, name string) *TunFile {
+	T := &TunFile{
+		File:     os.NewFile(fd, name),
+		counters: &IF.counters,
+	}
+
+	// super-packets are larger than the MTU by design
+	if IF.MTU > 0 && !IF.VnetHdr {
+		T.limit = int(IF.MTU)
+		if IF.TAP {
+			T.limit += 14
+		}
+	}
+
+	return T
+}
+
+func (T *TunFile) Read(data []byte) (n int, err error) {
+	n, err = T.File.Read(data)
+	T.counters.countRead(n, len(data), err)
+	return
+}
+
+func (T *TunFile) Write(data []byte) (n int, err error) {
+	n, err = T.File.Write(data)
+	T.counters.countWrite(n, len(data), T.limit, err)
+	return
+}
+
+// aLongTimeAgo is a deadline in the past, setting it wakes up blocked
+// reads and writes.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// ReadContext reads a packet like Read and returns ctx.Err() if ctx is
+// done before a packet arrives. It uses the read deadline, which must
+// not be changed while it is running.
+func (T *TunFile) ReadContext(ctx context.Context, data []byte) (n int, err error) {
+	err = T.withContext(ctx, T.File.SetReadDeadline, func() error {
+		n, err = T.Read(data)
+		return err
+	})
+	return
+}
+
+// WriteContext writes a packet like Write and returns ctx.Err() if ctx
+// is done before the packet could be written. It uses the write deadline,
+// which must not be changed while it is running.
+func (T *TunFile) WriteContext(ctx context.Context, data []byte) (n int, err error) {
+	err = T.withContext(ctx, T.File.SetWriteDeadline, func() error {
+		n, err = T.Write(data)
+		return err
+	})
+	return
+}
+
+func (T *TunFile) withContext(ctx context.Context, setDeadline func(time.Time) error, fn func() error) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	fired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		setDeadline(aLongTimeAgo)
+		close(fired)
+	})
+
+	err = fn()
+
+	if !stop() {
+		// wait for the deadline to be set before clearing it
+		<-fired
+		setDeadline(time.Time{})
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = ctx.Err()
+		}
+	}
+	return
+}
+
+// Syscall_HWAddr sets the MAC address of a TAP interface from IF.HardwareAddress.
+func (IF *Interface) Syscall_HWAddr() (err error) {
+	mac, err := net.ParseMAC(IF.HardwareAddress)
 	if err != nil {
 		return err
 	}
+	if len(mac) != 6 {
+		return fmt.Errorf("invalid ethernet address: %s", IF.HardwareAddress)
+	}
 
-	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(request), argp)
-	if errno != 0 {
-		return os.NewSyscallError("ioctl", errno)
+	var ifr syscallSetHWAddr
+	ifr.Family = syscall.ARPHRD_ETHER
+	copy(ifr.Name[:], []byte(IF.Name))
+	for i := range mac {
+		ifr.Data[i] = int8(mac[i])
+	}
+
+	return IF.do(func() error {
+		return socketCtl(
+			syscall.SIOCSIFHWADDR,
+			uintptr(unsafe.Pointer(&ifr)),
+		)
+	})
+}
+
+// Syscall_Carrier sets the carrier state of the device. The interface
+// reports NO-CARRIER while the carrier is off, even when it is UP.
+func (IF *Interface) Syscall_Carrier(on bool) (err error) {
+	var carrier int32
+	if on {
+		carrier = 1
+	}
+
+	return tunnelCtl(
+		IF.FD,
+		unix.TUNSETCARRIER,
+		uintptr(unsafe.Pointer(&carrier)),
+	)
+}
+
+// Syscall_Persist turns persistence of the device on or off. A device
+// that is not persistent is removed when its last file descriptor closes.
+func (IF *Interface) Syscall_Persist(on bool) (err error) {
+	var persist uintptr
+	if on {
+		persist = 1
+	}
+	set := func() error {
+		return tunnelCtl(IF.FD, syscall.TUNSETPERSIST, persist)
+	}
+
+	// a device made persistent here outlives a crash, so it is journaled
+	// like one created here
+	e, journaled := IF.journalEntry(JournalLink)
+	if journaled = journaled && journalEnabled(); journaled {
+		flags, err := IF.tunFlags()
+		if err != nil {
+			return err
+		}
+		// only a change of persistence is journaled
+		persistent := flags&unix.IFF_PERSIST != 0
+		journaled = persistent != on
+	}
+
+	switch {
+	case journaled && on:
+		e.Persistent = true
+		err = journalChange(e, set)
+	case journaled:
+		// the device goes away with its last file descriptor again
+		if err = set(); err == nil {
+			err = journalRevert(e)
+		}
+	default:
+		err = set()
+	}
+	if err != nil {
+		return err
 	}
+	IF.Persistent = on
 	return nil
 }
 
+// tunFlags returns the flags of the device, IFF_PERSIST among them.
+func (IF *Interface) tunFlags() (flags uint16, err error) {
+	var req syscallCreateIF
+	if err = tunnelCtl(IF.FD, syscall.TUNGETIFF, uintptr(unsafe.Pointer(&req))); err != nil {
+		return 0, err
+	}
+	return req.Flags, nil
+}
+
 func socketCtl(request uintptr, argp uintptr) error {
 	fd, err := syscall.Socket(
 		syscall.AF_INET,
@@ -377,80 +594,20 @@ func tunnelCtl(fd uintptr, request uintptr, argp uintptr) error {
 	return nil
 }
 
+// IP_AddRoute adds a route to network via gateway, replacing any existing
+// route with the same destination and metric.
 func IP_AddRoute(network string, gateway string, metric string) (err error) {
-	_ = IP_DelRoute(network, gateway, metric)
-	out, err := exec.Command("ip", "route", "add", network, "via", gateway, "metric", metric).CombinedOutput()
+	r, err := parseRouteArgs(network, gateway, metric)
 	if err != nil {
-		return errors.New("err :" + err.Error() + " || out: " + string(out))
+		return err
 	}
-	return
+	return RouteReplace(r)
 }
 
 func IP_DelRoute(network string, gateway string, metric string) (err error) {
-	out, err := exec.Command("ip", "route", "delete", network, "via", gateway, "metric", metric).CombinedOutput()
-	if err != nil {
-		return errors.New("err :" + err.Error() + " || out: " + string(out))
-	}
-	return
-}
-
-type syscallAddRoute struct {
-	Name [16]byte
-
-	rt_dst     syscall.RawSockaddrInet4 // Destination address
-	rt_gateway syscall.RawSockaddrInet4 // Gateway address
-	rt_genmask syscall.RawSockaddrInet4 // Netmask
-
-	rt_flags  uint16
-	Metric    int32
-	RefCount  int
-	Use       int
-	Priority  int
-	Device    [16]byte // Interface name
-	MTU       int
-	Window    int
-	IRTT      int
-	Reserved1 int
-	Reserved2 int
-}
-
-func (IF *Interface) Syscall_AddRoute_INPROGRESS(destination, gateway, netmask, name string) error {
-	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	r, err := parseRouteArgs(network, gateway, metric)
 	if err != nil {
 		return err
 	}
-	defer syscall.Close(sock)
-
-	var dst, gw, mask syscall.RawSockaddrInet4
-	var route syscallAddRoute
-	// copy(route.Device[:], []byte(name))
-
-	copy(dst.Addr[:], net.ParseIP(destination).To4())
-	dst.Family = syscall.AF_INET
-	// dst.Port = 0
-
-	copy(gw.Addr[:], net.ParseIP(gateway).To4())
-	gw.Family = syscall.AF_INET
-	// gw.Port = 0
-
-	copy(mask.Addr[:], net.ParseIP(netmask).To4())
-	mask.Family = syscall.AF_INET
-	// mask.Port = 0
-
-	route.rt_dst = dst
-	route.rt_gateway = gw
-	route.rt_genmask = mask
-	// route.Metric = 0
-	route.rt_flags = syscall.RTF_GATEWAY | syscall.RTF_UP
-	// route.Device = [16]byte{}
-	// copy(route.Device[:], ifaceName)
-
-	fmt.Println("ROUTE:", route)
-
-	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(sock), syscall.SIOCADDRT, uintptr(unsafe.Pointer(&route)))
-	if errno != 0 {
-		return fmt.Errorf("Failed to add route: %v", errno)
-	}
-
-	return nil
+	return RouteDel(r)
 }
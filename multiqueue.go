@@ -0,0 +1,124 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Queue is a single queue on a multiqueue interface. Every queue has
+// its own file descriptor and the kernel spreads flows across the
+// queues that are attached.
+type Queue struct {
+	Index int
+	FD    uintptr
+	RWC   io.ReadWriteCloser
+}
+
+// CreateQueues creates the interface with n queues. The first queue
+// uses IF.FD and IF.RWC, the remaining queues get their own descriptors.
+// IF.Multiqueue must be set.
+func (IF *Interface) CreateQueues(n int) (queues []*Queue, err error) {
+	if !IF.Multiqueue {
+		return nil, errors.New("interface is not a multiqueue interface")
+	}
+	if n < 1 {
+		return nil, errors.New("queue count must be at least 1")
+	}
+
+	if err = IF.Create(); err != nil {
+		return nil, err
+	}
+
+	queues = append(queues, &Queue{
+		Index: 0,
+		FD:    IF.FD,
+		RWC:   IF.RWC,
+	})
+
+	for i := 1; i < n; i++ {
+		fd, err := IF.open()
+		if err != nil {
+			for _, q := range queues[1:] {
+				q.RWC.Close()
+			}
+			return nil, err
+		}
+
+		queues = append(queues, &Queue{
+			Index: i,
+			FD:    uintptr(fd),
+			RWC:   IF.newTunFile(uintptr(fd), "tun_"+IF.Name+"_"+strconv.Itoa(i)),
+		})
+	}
+
+	IF.Queues = queues
+	return
+}
+
+// Attach enables the queue so the kernel will deliver packets to it.
+func (Q *Queue) Attach() (err error) {
+	return Q.setQueue(unix.IFF_ATTACH_QUEUE)
+}
+
+// Detach disables the queue, the kernel will stop delivering packets
+// to it until it is attached again.
+func (Q *Queue) Detach() (err error) {
+	return Q.setQueue(unix.IFF_DETACH_QUEUE)
+}
+
+func (Q *Queue) setQueue(flags uint16) (err error) {
+	var req syscallCreateIF
+	req.Flags = flags
+
+	return tunnelCtl(Q.FD, unix.TUNSETQUEUE, uintptr(unsafe.Pointer(&req)))
+}
+
+// Syscall_StopReader closes IF.RWC and every queue, readers and writers
+// blocked on them return os.ErrClosed. The interface itself is removed by
+// the kernel unless it is persistent.
+func (IF *Interface) Syscall_StopReader() (err error) {
+	var errs []error
+	if IF.uring != nil {
+		if cerr := IF.uring.Close(); cerr != nil {
+			errs = append(errs, cerr)
+		}
+	}
+
+	for _, q := range IF.Queues {
+		// the first queue shares IF.RWC
+		if q.RWC == IF.RWC {
+			continue
+		}
+		if cerr := q.RWC.Close(); cerr != nil && !errors.Is(cerr, os.ErrClosed) {
+			errs = append(errs, cerr)
+		}
+	}
+	IF.Queues = nil
+
+	if IF.RWC != nil {
+		if cerr := IF.RWC.Close(); cerr != nil && !errors.Is(cerr, os.ErrClosed) {
+			errs = append(errs, cerr)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// CloseQueues closes every queue on the interface.
+func (IF *Interface) CloseQueues() (err error) {
+	for _, q := range IF.Queues {
+		if cerr := q.RWC.Close(); cerr != nil && !errors.Is(cerr, syscall.EBADF) {
+			err = cerr
+		}
+	}
+	IF.Queues = nil
+	return
+}
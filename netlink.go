@@ -0,0 +1,296 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// ErrExists is matched by errors.Is when the kernel reports that the
+	// address, route or rule already exists.
+	ErrExists = errors.New("already exists")
+	// ErrNotFound is matched by errors.Is when the kernel reports that the
+	// address, route, rule or link does not exist.
+	ErrNotFound = errors.New("not found")
+)
+
+// NetlinkError is returned when the kernel rejects a netlink request.
+// It unwraps to the syscall.Errno so callers can use errors.Is.
+type NetlinkError struct {
+	Op      string
+	Errno   syscall.Errno
+	Message string
+}
+
+func (e *NetlinkError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("netlink %s: %s (%s)", e.Op, e.Errno.Error(), e.Message)
+	}
+	return fmt.Sprintf("netlink %s: %s", e.Op, e.Errno.Error())
+}
+
+func (e *NetlinkError) Unwrap() error {
+	return e.Errno
+}
+
+func (e *NetlinkError) Is(target error) bool {
+	switch target {
+	case ErrExists:
+		return e.Errno == syscall.EEXIST
+	case ErrNotFound:
+		return e.Errno == syscall.ENOENT || e.Errno == syscall.ESRCH ||
+			e.Errno == syscall.ENODEV || e.Errno == syscall.EADDRNOTAVAIL
+	}
+	return false
+}
+
+// netlinkAttr is a single route attribute from a netlink message.
+type netlinkAttr struct {
+	Type  uint16
+	Value []byte
+}
+
+type netlinkAttrs []netlinkAttr
+
+func (a netlinkAttrs) get(t uint16) []byte {
+	for i := range a {
+		if a[i].Type == t {
+			return a[i].Value
+		}
+	}
+	return nil
+}
+
+func (a netlinkAttrs) uint32(t uint16) uint32 {
+	v := a.get(t)
+	if len(v) < 4 {
+		return 0
+	}
+	return binary.NativeEndian.Uint32(v)
+}
+
+func (a netlinkAttrs) string(t uint16) string {
+	v := a.get(t)
+	for i := range v {
+		if v[i] == 0 {
+			return string(v[:i])
+		}
+	}
+	return string(v)
+}
+
+func parseNetlinkAttrs(b []byte) (attrs netlinkAttrs) {
+	for len(b) >= unix.SizeofRtAttr {
+		l := int(binary.NativeEndian.Uint16(b[0:]))
+		t := binary.NativeEndian.Uint16(b[2:])
+		if l < unix.SizeofRtAttr || l > len(b) {
+			break
+		}
+		attrs = append(attrs, netlinkAttr{
+			Type:  t &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER),
+			Value: b[unix.SizeofRtAttr:l],
+		})
+		b = b[netlinkAlign(l):]
+	}
+	return
+}
+
+func netlinkAlign(l int) int {
+	return (l + unix.NLMSG_ALIGNTO - 1) & ^(unix.NLMSG_ALIGNTO - 1)
+}
+
+// netlinkMessage builds a single netlink request.
+type netlinkMessage struct {
+	Type  uint16
+	Flags uint16
+	data  []byte
+}
+
+func newNetlinkMessage(t uint16, flags uint16, body unsafe.Pointer, size int) *netlinkMessage {
+	m := &netlinkMessage{Type: t, Flags: flags}
+	m.data = append(m.data, unsafe.Slice((*byte)(body), size)...)
+	m.pad()
+	return m
+}
+
+func (m *netlinkMessage) pad() {
+	for len(m.data)%unix.NLMSG_ALIGNTO != 0 {
+		m.data = append(m.data, 0)
+	}
+}
+
+func (m *netlinkMessage) addAttr(t uint16, v []byte) {
+	var hdr [unix.SizeofRtAttr]byte
+	binary.NativeEndian.PutUint16(hdr[0:], uint16(unix.SizeofRtAttr+len(v)))
+	binary.NativeEndian.PutUint16(hdr[2:], t)
+	m.data = append(m.data, hdr[:]...)
+	m.data = append(m.data, v...)
+	m.pad()
+}
+
+func (m *netlinkMessage) addUint32(t uint16, v uint32) {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, v)
+	m.addAttr(t, b)
+}
+
+func (m *netlinkMessage) addString(t uint16, v string) {
+	m.addAttr(t, append([]byte(v), 0))
+}
+
+// nest adds a nested attribute, attributes added inside fn end up
+// inside of it.
+func (m *netlinkMessage) nest(t uint16, fn func()) {
+	start := len(m.data)
+	m.addAttr(t|unix.NLA_F_NESTED, nil)
+	fn()
+	binary.NativeEndian.PutUint16(m.data[start:], uint16(len(m.data)-start))
+}
+
+type netlinkSocket struct {
+	fd  int
+	seq uint32
+}
+
+func openNetlink() (*netlinkSocket, error) {
+	fd, err := syscall.Socket(
+		syscall.AF_NETLINK,
+		syscall.SOCK_RAW|syscall.SOCK_CLOEXEC,
+		syscall.NETLINK_ROUTE,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	// extended acks give us the reason the kernel rejected a request,
+	// older kernels do not support them which is fine.
+	_ = syscall.SetsockoptInt(fd, unix.SOL_NETLINK, unix.NETLINK_EXT_ACK, 1)
+
+	return &netlinkSocket{fd: fd}, nil
+}
+
+func (s *netlinkSocket) Close() error {
+	return syscall.Close(s.fd)
+}
+
+// execute sends m and collects the replies. Requests are always sent with
+// NLM_F_ACK so the kernel reports success or failure of every request.
+func (s *netlinkSocket) execute(op string, m *netlinkMessage) (replies [][]byte, err error) {
+	s.seq++
+	seq := s.seq
+
+	buf := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(m.data))
+	binary.NativeEndian.PutUint32(buf[0:], uint32(unix.SizeofNlMsghdr+len(m.data)))
+	binary.NativeEndian.PutUint16(buf[4:], m.Type)
+	binary.NativeEndian.PutUint16(buf[6:], m.Flags|unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	binary.NativeEndian.PutUint32(buf[8:], seq)
+	buf = append(buf, m.data...)
+
+	if err = syscall.Sendto(s.fd, buf, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	for {
+		// replies point into rb, so it can not be reused between reads
+		rb := make([]byte, 1<<16)
+		n, _, err := syscall.Recvfrom(s.fd, rb, 0)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return nil, err
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(rb[:n])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, msg := range msgs {
+			if msg.Header.Seq != seq {
+				continue
+			}
+
+			switch msg.Header.Type {
+			case unix.NLMSG_DONE:
+				if len(msg.Data) >= 4 {
+					if errno := int32(binary.NativeEndian.Uint32(msg.Data)); errno < 0 {
+						return nil, &NetlinkError{Op: op, Errno: syscall.Errno(-errno)}
+					}
+				}
+				return replies, nil
+			case unix.NLMSG_ERROR:
+				return replies, parseNetlinkError(op, msg)
+			default:
+				replies = append(replies, msg.Data)
+			}
+		}
+	}
+}
+
+func parseNetlinkError(op string, msg syscall.NetlinkMessage) error {
+	if len(msg.Data) < unix.SizeofNlMsgerr {
+		return errors.New("netlink " + op + ": short error message")
+	}
+	errno := int32(binary.NativeEndian.Uint32(msg.Data))
+	if errno == 0 {
+		return nil
+	}
+
+	nerr := &NetlinkError{Op: op, Errno: syscall.Errno(-errno)}
+
+	if msg.Header.Flags&unix.NLM_F_ACK_TLVS != 0 {
+		// the original request is echoed back unless NLM_F_CAPPED is set
+		offset := unix.SizeofNlMsgerr
+		if msg.Header.Flags&unix.NLM_F_CAPPED == 0 {
+			offset = 4 + int(binary.NativeEndian.Uint32(msg.Data[4:]))
+		}
+		if offset <= len(msg.Data) {
+			nerr.Message = parseNetlinkAttrs(msg.Data[offset:]).string(unix.NLMSGERR_ATTR_MSG)
+		}
+	}
+
+	return nerr
+}
+
+// netlinkExecute opens a netlink socket, runs a single request and
+// closes the socket again.
+func netlinkExecute(op string, m *netlinkMessage) ([][]byte, error) {
+	s, err := openNetlink()
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	return s.execute(op, m)
+}
+
+// linkIndex returns the interface index of the link with the given name.
+func linkIndex(name string) (int, error) {
+	var ifi unix.IfInfomsg
+	m := newNetlinkMessage(unix.RTM_GETLINK, 0, unsafe.Pointer(&ifi), unix.SizeofIfInfomsg)
+	m.addString(unix.IFLA_IFNAME, name)
+
+	replies, err := netlinkExecute("getlink", m)
+	if err != nil {
+		return 0, err
+	}
+	if len(replies) == 0 || len(replies[0]) < unix.SizeofIfInfomsg {
+		return 0, &NetlinkError{Op: "getlink", Errno: syscall.ENODEV}
+	}
+
+	reply := (*unix.IfInfomsg)(unsafe.Pointer(&replies[0][0]))
+	return int(reply.Index), nil
+}
@@ -0,0 +1,162 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// NetNSDir is where named network namespaces are mounted, same as ip netns.
+const NetNSDir = "/var/run/netns"
+
+// NetNS is a reference to a network namespace.
+type NetNS struct {
+	Name string
+	FD   int
+}
+
+// OpenNetNS opens the named network namespace.
+func OpenNetNS(name string) (ns *NetNS, err error) {
+	fd, err := syscall.Open(filepath.Join(NetNSDir, name), syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &NetNS{Name: name, FD: fd}, nil
+}
+
+// NetNSFromFD wraps a namespace file descriptor, for example one opened
+// from /proc/<pid>/ns/net. The NetNS takes ownership of fd.
+func NetNSFromFD(fd int) *NetNS {
+	return &NetNS{FD: fd}
+}
+
+// NewNetNS creates a new named network namespace and mounts it in
+// NetNSDir so it outlives the process, use DeleteNetNS to remove it.
+func NewNetNS(name string) (ns *NetNS, err error) {
+	if err = os.MkdirAll(NetNSDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(NetNSDir, name)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDONLY, 0o444)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	err = onNewThread(func() (err error) {
+		if err = unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			return err
+		}
+		return unix.Mount("/proc/thread-self/ns/net", path, "none", unix.MS_BIND, "")
+	})
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	return OpenNetNS(name)
+}
+
+// DeleteNetNS unmounts and removes the named network namespace. The
+// namespace is destroyed by the kernel once nothing uses it anymore.
+func DeleteNetNS(name string) (err error) {
+	path := filepath.Join(NetNSDir, name)
+	if err = unix.Unmount(path, unix.MNT_DETACH); err != nil && err != syscall.EINVAL {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (ns *NetNS) Close() error {
+	return syscall.Close(ns.FD)
+}
+
+// Do runs fn on an OS thread that has joined the namespace. Sockets,
+// netlink requests and tun devices created by fn belong to the namespace,
+// goroutines started by fn do not.
+func (ns *NetNS) Do(fn func() error) (err error) {
+	return onNewThread(func() error {
+		if err := unix.Setns(ns.FD, unix.CLONE_NEWNET); err != nil {
+			return err
+		}
+		return fn()
+	})
+}
+
+// onNewThread runs fn on a locked OS thread. The thread is thrown away
+// afterwards since fn may have changed its namespace.
+func onNewThread(fn func() error) (err error) {
+	done := make(chan error, 1)
+
+	go func() {
+		// the thread is never unlocked, so the runtime terminates it
+		// when this goroutine exits.
+		runtime.LockOSThread()
+		done <- fn()
+	}()
+
+	return <-done
+}
+
+// processNetNS is the namespace the process started in, package
+// variables are initialized on the main thread before any namespace is
+// entered.
+var processNetNS, processNetNSErr = statNetNS("/proc/thread-self/ns/net")
+
+func statNetNS(path string) (st syscall.Stat_t, err error) {
+	err = syscall.Stat(path, &st)
+	return
+}
+
+// threadNetNS returns the name of the namespace the calling thread is in,
+// an empty name for the namespace of the process. ok is false when the
+// namespace is not mounted in NetNSDir.
+func threadNetNS() (name string, ok bool) {
+	thread, err := statNetNS("/proc/thread-self/ns/net")
+	if err != nil || processNetNSErr != nil {
+		return "", false
+	}
+	if thread.Dev == processNetNS.Dev && thread.Ino == processNetNS.Ino {
+		return "", true
+	}
+
+	entries, err := os.ReadDir(NetNSDir)
+	if err != nil {
+		return "", false
+	}
+	for _, d := range entries {
+		st, err := statNetNS(filepath.Join(NetNSDir, d.Name()))
+		if err == nil && st.Dev == thread.Dev && st.Ino == thread.Ino {
+			return d.Name(), true
+		}
+	}
+	return "", false
+}
+
+// do runs fn inside the namespace of the interface, if it has one.
+func (IF *Interface) do(fn func() error) (err error) {
+	if IF.NetNS == nil {
+		return fn()
+	}
+	return IF.NetNS.Do(fn)
+}
+
+// SetNetNS moves the interface into ns, addresses are lost in the move.
+// Later calls on the interface are made inside ns.
+func (IF *Interface) SetNetNS(ns *NetNS) (err error) {
+	err = IF.setLink("netns", 0, 0, func(m *netlinkMessage) {
+		m.addUint32(unix.IFLA_NET_NS_FD, uint32(ns.FD))
+	})
+	if err != nil {
+		return err
+	}
+
+	IF.NetNS = ns
+	return nil
+}
@@ -0,0 +1,144 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultHeadroom is the space reserved in front of every packet for
+// encapsulation headers, enough for an outer IPv6, UDP and tunnel header.
+const DefaultHeadroom = 128
+
+// ErrPacketTooLarge is returned when a packet does not fit in a buffer.
+var ErrPacketTooLarge = errors.New("packet is larger than the buffer")
+
+// ErrPacketReleased is returned when a packet is released again.
+var ErrPacketReleased = errors.New("packet was already released")
+
+// Packet is a buffer from a PacketPool. Data is the packet itself, the
+// headroom in front of it can be claimed with Prepend to add headers
+// without copying the packet. A packet must be released once and must
+// not be used after that.
+type Packet struct {
+	Data []byte
+
+	buf      []byte
+	pool     *PacketPool
+	released atomic.Bool
+}
+
+// Headroom returns the number of bytes that can still be prepended.
+func (p *Packet) Headroom() int {
+	return cap(p.buf) - cap(p.Data)
+}
+
+// Prepend grows Data by n bytes to the front and returns the new bytes.
+func (p *Packet) Prepend(n int) ([]byte, error) {
+	start := p.Headroom() - n
+	if start < 0 {
+		return nil, ErrPacketTooLarge
+	}
+	p.Data = p.buf[start : start+n+len(p.Data)]
+	return p.Data[:n], nil
+}
+
+// Reset empties the packet and restores the full headroom.
+func (p *Packet) Reset() {
+	p.Data = p.buf[p.pool.headroom:p.pool.headroom]
+}
+
+// Full returns Data extended to the end of the buffer, reads fill it.
+func (p *Packet) Full() []byte {
+	return p.Data[:cap(p.Data)]
+}
+
+// Release returns the packet to its pool, ErrPacketReleased is returned
+// when it was released before.
+func (p *Packet) Release() (err error) {
+	if p.released.Swap(true) {
+		return ErrPacketReleased
+	}
+	p.pool.pool.Put(p)
+	return nil
+}
+
+// PacketPool hands out packets with room for Size bytes of packet
+// behind Headroom bytes of free space. Packets are reused after they
+// are released so the steady state allocates nothing.
+type PacketPool struct {
+	size     int
+	headroom int
+	pool     sync.Pool
+}
+
+// NewPacketPool returns a pool for packets of up to size bytes, usually
+// the MTU of the interface, with headroom bytes in front of each packet.
+func NewPacketPool(size int, headroom int) *PacketPool {
+	P := &PacketPool{
+		size:     size,
+		headroom: headroom,
+	}
+	P.pool.New = func() any {
+		p := &Packet{
+			buf:  make([]byte, headroom+size),
+			pool: P,
+		}
+		p.released.Store(true)
+		return p
+	}
+	return P
+}
+
+// Size returns the largest packet the pool can hold.
+func (P *PacketPool) Size() int {
+	return P.size
+}
+
+// Headroom returns the free space in front of every packet.
+func (P *PacketPool) Headroom() int {
+	return P.headroom
+}
+
+// Get returns an empty packet, use Full to read into it.
+func (P *PacketPool) Get() *Packet {
+	p := P.pool.Get().(*Packet)
+	p.released.Store(false)
+	p.Reset()
+	return p
+}
+
+// packetTracker maps the byte slices handed out by ReceivePacket and
+// AllocateSendPacket back to their packets. They are keyed on the last
+// byte of the buffer, which stays the same when the slice is resliced.
+type packetTracker struct {
+	mu       sync.Mutex
+	inflight map[*byte]*Packet
+}
+
+func trackerKey(b []byte) *byte {
+	return &b[:cap(b)][cap(b)-1]
+}
+
+func (t *packetTracker) track(p *Packet) {
+	t.mu.Lock()
+	if t.inflight == nil {
+		t.inflight = make(map[*byte]*Packet)
+	}
+	t.inflight[trackerKey(p.buf)] = p
+	t.mu.Unlock()
+}
+
+func (t *packetTracker) untrack(b []byte) (p *Packet, ok bool) {
+	if cap(b) == 0 {
+		return nil, false
+	}
+	t.mu.Lock()
+	key := trackerKey(b)
+	p, ok = t.inflight[key]
+	delete(t.inflight, key)
+	t.mu.Unlock()
+	return
+}
@@ -0,0 +1,118 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// errRawConnClosed is the error a RawConn returns once its file is
+// closed. The os package does not export it, so it is taken from a file
+// that is already closed instead of matching the message, which is not
+// part of any API.
+var errRawConnClosed = func() error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil
+	}
+	w.Close()
+	rc, err := r.SyscallConn()
+	r.Close()
+	if err != nil {
+		return nil
+	}
+	return rc.Read(func(uintptr) bool { return true })
+}()
+
+// rawConnErr maps the error a RawConn returns for a closed file to
+// os.ErrClosed, the methods of os.File do the same.
+func rawConnErr(err error) error {
+	if err != nil && errRawConnClosed != nil && errors.Is(err, errRawConnClosed) {
+		return os.ErrClosed
+	}
+	return err
+}
+
+// pollRead calls fn until it reports done, parking in the runtime poller
+// whenever the socket has nothing to read. With busy set fn is retried
+// for that long before parking. Deadlines and Close end the wait.
+func pollRead(rc syscall.RawConn, busy time.Duration, fn func(fd int) (done bool)) error {
+	err := rc.Read(func(fd uintptr) bool {
+		var spinUntil time.Time
+		for {
+			if fn(int(fd)) {
+				return true
+			}
+			if busy <= 0 {
+				return false
+			}
+			if spinUntil.IsZero() {
+				spinUntil = time.Now().Add(busy)
+			} else if time.Now().After(spinUntil) {
+				return false
+			}
+		}
+	})
+	return rawConnErr(err)
+}
+
+// wrapSocket registers the read socket with the runtime poller and turns
+// on busy polling when r.BusyPoll is set.
+func (r *RawSocket) wrapSocket(fd int) (err error) {
+	if r.BusyPoll > 0 {
+		usec := int(r.BusyPoll / time.Microsecond)
+		if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, unix.SO_BUSY_POLL, usec); err != nil {
+			return os.NewSyscallError("setsockopt SO_BUSY_POLL", err)
+		}
+	}
+
+	r.file = os.NewFile(uintptr(fd), "raw_"+r.InterfaceName)
+	if r.rc, err = r.file.SyscallConn(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return nil
+}
+
+func (r *RawSocket) deadlineFile() (*os.File, error) {
+	if r.file == nil {
+		return nil, errors.New("socket is not open")
+	}
+	return r.file, nil
+}
+
+// SetDeadline sets the read and write deadlines of the socket. Writes
+// outside of ring mode never wait, so only reads are affected there.
+func (r *RawSocket) SetDeadline(t time.Time) error {
+	f, err := r.deadlineFile()
+	if err != nil {
+		return err
+	}
+	return f.SetDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for Read, ReadMsg, ReadBatch,
+// ReadPacket and ReadBlock, os.ErrDeadlineExceeded is returned once it
+// passes. A zero time means no deadline.
+func (r *RawSocket) SetReadDeadline(t time.Time) error {
+	f, err := r.deadlineFile()
+	if err != nil {
+		return err
+	}
+	return f.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for writes that wait for room on
+// the TX ring.
+func (r *RawSocket) SetWriteDeadline(t time.Time) error {
+	f, err := r.deadlineFile()
+	if err != nil {
+		return err
+	}
+	return f.SetWriteDeadline(t)
+}
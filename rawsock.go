@@ -3,10 +3,13 @@
 package tunnels
 
 import (
-	"encoding/binary"
 	"io"
+	"os"
 	"syscall"
+	"time"
 	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 type RawSocket struct {
@@ -14,16 +17,63 @@ type RawSocket struct {
 	IPv4Address   string
 	IPv6Address   string
 	InterfaceName string
-	SocketBuffer  []byte
+	// SocketBuffer sets the size of the reads posted with IOUring, Read
+	// fills the buffer it is given.
+	SocketBuffer []byte
 
 	Domain int
 	Type   int
 	Proto  int
 
 	RWC io.ReadWriteCloser
+
+	// IOUring makes ReadBatch use io_uring with IOUringEntries reads
+	// posted, recvmmsg is used when io_uring is not available.
+	IOUring        bool
+	IOUringEntries int
+
+	// Ring switches the socket to AF_PACKET with TPACKET_V3 rings mapped
+	// into memory, Domain, Type and Proto are ignored.
+	Ring *PacketRing
+
+	// BusyPoll makes reads spin for up to this long before they wait in
+	// the runtime poller, and sets SO_BUSY_POLL so the kernel polls the
+	// device queue while they do. It trades a CPU core for latency.
+	BusyPoll time.Duration
+
+	// CPUs[0] is the CPU RunIOThreads pins the packet loop to, the first
+	// CPU the process is allowed to use when empty.
+	CPUs []int
+
+	fd      int
+	file    *os.File
+	rc      syscall.RawConn
+	uring   *Uring
+	threads ioThreads
+	ring    *packetRing
+
+	// reused by ReadMsg
+	oob []byte
+
+	// used for writing, see createSendSockets
+	sfd     int
+	sfd6    int
+	ifIndex uint32
+
+	// reused by ReadBatch and WriteBatch
+	readMsgs   []mmsghdr
+	readIovs   []unix.Iovec
+	writeMsgs  []mmsghdr
+	writeIovs  []unix.Iovec
+	writeAddrs []syscall.RawSockaddrInet6
+	writeFds   []int
 }
 
 func (r *RawSocket) Create() (err error) {
+	if r.Ring != nil {
+		return r.createRing()
+	}
+
 	fd, sockErr := syscall.Socket(
 		r.Domain,
 		r.Type,
@@ -50,98 +100,138 @@ func (r *RawSocket) Create() (err error) {
 		return err
 	}
 
-	sfd, sockErr := syscall.Socket(
-		syscall.AF_INET,
-		syscall.SOCK_RAW,
-		syscall.IPPROTO_RAW,
-	)
-	if sockErr != nil {
+	err = syscall.BindToDevice(fd, r.InterfaceName)
+	if err != nil {
 		syscall.Close(fd)
-		return sockErr
+		return err
 	}
 
-	err = syscall.BindToDevice(fd, r.InterfaceName)
-	if err != nil {
+	if err = r.createSendSockets(); err != nil {
 		syscall.Close(fd)
-		panic(err)
+		return err
 	}
 
-	addr := syscall.RawSockaddrInet4{
-		Family: syscall.AF_INET,
+	if err = r.wrapSocket(fd); err != nil {
+		syscall.Close(fd)
+		r.closeSendSockets()
+		return err
 	}
 
-	r.RWC = &RWC{
-		fd:         fd,
-		fdPtr:      uintptr(fd),
-		buffPtr:    uintptr(unsafe.Pointer(&r.SocketBuffer[0])),
-		buffLenPtr: uintptr(len(r.SocketBuffer)),
+	r.fd = fd
+	r.enableMsgInfo()
+
+	if r.IOUring {
+		size := len(r.SocketBuffer)
+		if size == 0 {
+			size = 0xffff
+		}
+		r.uring, err = NewUring(fd, r.IOUringEntries, size)
+		if err != nil && err != ErrUringUnavailable {
+			r.file.Close()
+			r.closeSendSockets()
+			return err
+		}
+		err = nil
+	}
 
-		sfd:        sfd,
-		sfdPtr:     uintptr(sfd),
-		addr:       &addr,
-		addrLenPtr: uintptr(0x10),
-		addrPtr:    uintptr(unsafe.Pointer(&addr)),
+	r.RWC = &RWC{
+		socket: r,
 	}
 
 	return nil
 }
 
+// Close stops io_uring reads and closes every socket, the socket used for
+// reading is closed through RWC.
+func (r *RawSocket) Close() (err error) {
+	if r.ring != nil {
+		return r.ring.Close()
+	}
+	if r.uring != nil {
+		err = r.uring.Close()
+	}
+	if cerr := r.RWC.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := r.closeSendSockets(); err == nil {
+		err = cerr
+	}
+	return
+}
+
 type RWC struct {
-	fd    int
-	fdPtr uintptr
-
-	// used for reading
-	r0         uintptr
-	e1         syscall.Errno
-	buffPtr    uintptr
-	buffLenPtr uintptr
-	// msg specific reading
-
-	// user for writing
-	sfd        int
-	sfdPtr     uintptr
-	addr       *syscall.RawSockaddrInet4
-	addrPtr    uintptr
-	addrLenPtr uintptr
+	socket *RawSocket
+
+	// used for writing
+	addr syscall.RawSockaddrInet6
 }
 
+// Read receives a single packet into data, it blocks until a packet
+// arrives, the read deadline passes or the socket is closed. A packet
+// larger than data is truncated.
 func (rwc *RWC) Read(data []byte) (n int, err error) {
-	rwc.r0, _, rwc.e1 = syscall.Syscall6(
-		syscall.SYS_RECVFROM,
-		rwc.fdPtr,
-		rwc.buffPtr,
-		rwc.buffLenPtr,
-		0,
-		0,
-		0,
-	)
-	n = int(rwc.r0)
+	if len(data) == 0 {
+		return 0, nil
+	}
 
-	return
+	perr := pollRead(rwc.socket.rc, rwc.socket.BusyPoll, func(fd int) bool {
+	retry:
+		r0, _, e1 := syscall.Syscall6(
+			syscall.SYS_RECVFROM,
+			uintptr(fd),
+			uintptr(unsafe.Pointer(&data[0])),
+			uintptr(len(data)),
+			0,
+			0,
+			0,
+		)
+		switch e1 {
+		case 0:
+			n = int(r0)
+		case syscall.EINTR:
+			goto retry
+		case syscall.EAGAIN:
+			return false
+		default:
+			err = e1
+		}
+		return true
+	})
+	if err == nil {
+		err = perr
+	}
+	return n, err
 }
 
+// Write sends a single IPv4 or IPv6 packet, the header included. The
+// destination is taken from the header and the packet must be complete,
+// ErrInvalidPacket is returned otherwise.
 func (rwc *RWC) Write(data []byte) (n int, err error) {
-	rwc.addr.Addr[0] = data[16]
-	rwc.addr.Addr[1] = data[17]
-	rwc.addr.Addr[2] = data[18]
-	rwc.addr.Addr[3] = data[19]
-	IHL := ((data[0] << 4) >> 4) * 4
-	rwc.addr.Port = binary.BigEndian.Uint16(data[IHL+2 : IHL+4])
-	_, _, e1 := syscall.Syscall6(
-		syscall.SYS_SENDTO,
-		rwc.sfdPtr,
-		uintptr(unsafe.Pointer(&data[0])),
-		uintptr(len(data)),
-		0,
-		rwc.addrPtr,
-		rwc.addrLenPtr,
-	)
-	if e1 != 0 {
-		return 0, e1
+	fd, salen, err := rwc.socket.destination(data, &rwc.addr)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		_, _, e1 := syscall.Syscall6(
+			syscall.SYS_SENDTO,
+			uintptr(fd),
+			uintptr(unsafe.Pointer(&data[0])),
+			uintptr(len(data)),
+			0,
+			uintptr(unsafe.Pointer(&rwc.addr)),
+			uintptr(salen),
+		)
+		if e1 == syscall.EINTR {
+			continue
+		}
+		if e1 != 0 {
+			return 0, e1
+		}
+		return len(data), nil
 	}
-	return 0, nil
 }
 
 func (rwc *RWC) Close() error {
-	return syscall.Close(rwc.fd)
+	return rwc.socket.file.Close()
 }
@@ -0,0 +1,153 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrInvalidPacket is returned when a packet handed to a RawSocket write
+// is not a complete IPv4 or IPv6 packet, or is an IPv6 packet without a
+// source address.
+var ErrInvalidPacket = errors.New("invalid IP packet")
+
+// createSendSockets opens the sockets used for writing. Packets are
+// written with their IP header included, so any protocol can be sent.
+// The IPv4 socket is bound to r.IPv4Address and the IPv6 socket to
+// r.IPv6Address when they are set. The IPv6 socket is left out when the
+// kernel has no IPv6 and no IPv6Address is set.
+func (r *RawSocket) createSendSockets() (err error) {
+	r.sfd, r.sfd6 = -1, -1
+	defer func() {
+		if err != nil {
+			r.closeSendSockets()
+		}
+	}()
+
+	if r.InterfaceName != "" {
+		ifi, err := net.InterfaceByName(r.InterfaceName)
+		if err != nil {
+			return err
+		}
+		r.ifIndex = uint32(ifi.Index)
+	}
+
+	// IPPROTO_RAW implies IP_HDRINCL
+	if r.sfd, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.IPPROTO_RAW); err != nil {
+		return err
+	}
+	if r.IPv4Address != "" {
+		addr, perr := netip.ParseAddr(r.IPv4Address)
+		if perr != nil || !addr.Is4() {
+			return errors.New("invalid IPv4 address: " + r.IPv4Address)
+		}
+		if err = syscall.Bind(r.sfd, &syscall.SockaddrInet4{Addr: addr.As4()}); err != nil {
+			return err
+		}
+	}
+
+	fd6, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.IPPROTO_RAW)
+	if err != nil {
+		if r.IPv6Address == "" && err == syscall.EAFNOSUPPORT {
+			return nil
+		}
+		return err
+	}
+	r.sfd6 = fd6
+	if err = syscall.SetsockoptInt(r.sfd6, syscall.IPPROTO_IPV6, unix.IPV6_HDRINCL, 1); err != nil {
+		return err
+	}
+	if r.IPv6Address != "" {
+		addr, perr := netip.ParseAddr(r.IPv6Address)
+		if perr != nil || !addr.Is6() || addr.Is4In6() {
+			return errors.New("invalid IPv6 address: " + r.IPv6Address)
+		}
+		sa := &syscall.SockaddrInet6{Addr: addr.As16()}
+		if addr.IsLinkLocalUnicast() {
+			sa.ZoneId = r.ifIndex
+		}
+		if err = syscall.Bind(r.sfd6, sa); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *RawSocket) closeSendSockets() (err error) {
+	if r.sfd >= 0 {
+		err = syscall.Close(r.sfd)
+		r.sfd = -1
+	}
+	if r.sfd6 >= 0 {
+		if cerr := syscall.Close(r.sfd6); err == nil {
+			err = cerr
+		}
+		r.sfd6 = -1
+	}
+	return
+}
+
+// destination checks that packet is a complete IPv4 or IPv6 packet and
+// stores its destination in sa. It returns the socket the packet is sent
+// on and the length of the address.
+//
+// The kernel fills in an unspecified IPv4 source from the bound address
+// but leaves IPv6 headers alone, so IPv6 packets without a source are
+// rejected.
+func (r *RawSocket) destination(packet []byte, sa *syscall.RawSockaddrInet6) (fd int, salen uint32, err error) {
+	if len(packet) == 0 {
+		return -1, 0, ErrInvalidPacket
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return -1, 0, ErrInvalidPacket
+		}
+		ihl := int(packet[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(packet[2:4]))
+		if ihl < 20 || ihl > len(packet) || total != len(packet) {
+			return -1, 0, ErrInvalidPacket
+		}
+
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		*sa4 = syscall.RawSockaddrInet4{Family: syscall.AF_INET}
+		copy(sa4.Addr[:], packet[16:20])
+		return r.sfd, syscall.SizeofSockaddrInet4, nil
+
+	case 6:
+		if len(packet) < 40 {
+			return -1, 0, ErrInvalidPacket
+		}
+		// jumbograms are not supported
+		payload := int(binary.BigEndian.Uint16(packet[4:6]))
+		if payload+40 != len(packet) {
+			return -1, 0, ErrInvalidPacket
+		}
+		if r.sfd6 < 0 {
+			return -1, 0, errors.New("IPv6 is not available")
+		}
+
+		if netip.AddrFrom16([16]byte(packet[8:24])).IsUnspecified() {
+			return -1, 0, ErrInvalidPacket
+		}
+
+		*sa = syscall.RawSockaddrInet6{Family: syscall.AF_INET6}
+		copy(sa.Addr[:], packet[24:40])
+		dst := netip.AddrFrom16(sa.Addr)
+		if dst.IsLinkLocalUnicast() || dst.IsLinkLocalMulticast() || dst.IsInterfaceLocalMulticast() {
+			sa.Scope_id = r.ifIndex
+		}
+		return r.sfd6, syscall.SizeofSockaddrInet6, nil
+	}
+
+	return -1, 0, ErrInvalidPacket
+}
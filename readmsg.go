@@ -0,0 +1,124 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"errors"
+	"net/netip"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// PacketInfo is what the kernel knows about a packet read with ReadMsg.
+type PacketInfo struct {
+	// N is the number of bytes stored in the buffer.
+	N int
+	// Truncated is set when the packet was larger than the buffer.
+	Truncated bool
+	// Source is the address the packet came from.
+	Source netip.Addr
+	// IfIndex is the index of the interface the packet arrived on.
+	IfIndex int
+	// Destination is the destination address of the packet.
+	Destination netip.Addr
+	// TTL is the TTL, or the hop limit for IPv6, -1 when unknown.
+	TTL int
+	// Timestamp is when the kernel received the packet.
+	Timestamp time.Time
+}
+
+// enableMsgInfo asks the kernel for the control messages parsed by
+// ReadMsg. Sockets that do not support an option simply go without.
+func (r *RawSocket) enableMsgInfo() {
+	switch r.Domain {
+	case syscall.AF_INET:
+		syscall.SetsockoptInt(r.fd, syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+		syscall.SetsockoptInt(r.fd, syscall.IPPROTO_IP, syscall.IP_RECVTTL, 1)
+	case syscall.AF_INET6:
+		syscall.SetsockoptInt(r.fd, syscall.IPPROTO_IPV6, unix.IPV6_RECVPKTINFO, 1)
+		syscall.SetsockoptInt(r.fd, syscall.IPPROTO_IPV6, unix.IPV6_RECVHOPLIMIT, 1)
+	default:
+		return
+	}
+	syscall.SetsockoptInt(r.fd, syscall.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1)
+}
+
+// ReadMsg receives a single packet into data with recvmsg and returns
+// the source address, ingress interface, TTL and kernel timestamp along
+// with it. It blocks like Read.
+func (r *RawSocket) ReadMsg(data []byte) (info PacketInfo, err error) {
+	if r.ring != nil {
+		return info, errors.New("ReadMsg is not supported in ring mode")
+	}
+
+	if r.oob == nil {
+		r.oob = make([]byte, unix.CmsgSpace(unix.SizeofInet6Pktinfo)+
+			unix.CmsgSpace(4)+
+			unix.CmsgSpace(int(unsafe.Sizeof(unix.Timespec{}))))
+	}
+
+	var oobn, flags int
+	var from unix.Sockaddr
+	perr := pollRead(r.rc, r.BusyPoll, func(fd int) bool {
+		for {
+			info.N, oobn, flags, from, err = unix.Recvmsg(fd, data, r.oob, 0)
+			if err != unix.EINTR {
+				return err != unix.EAGAIN
+			}
+		}
+	})
+	if err == nil || err == unix.EAGAIN {
+		err = perr
+	}
+	if err != nil {
+		return PacketInfo{}, err
+	}
+
+	info.Truncated = flags&unix.MSG_TRUNC != 0
+	info.TTL = -1
+	switch sa := from.(type) {
+	case *unix.SockaddrInet4:
+		info.Source = netip.AddrFrom4(sa.Addr)
+	case *unix.SockaddrInet6:
+		info.Source = netip.AddrFrom16(sa.Addr)
+	}
+
+	cmsgs, err := unix.ParseSocketControlMessage(r.oob[:oobn])
+	if err != nil {
+		return info, err
+	}
+	for _, m := range cmsgs {
+		info.parse(m)
+	}
+
+	return info, nil
+}
+
+func (info *PacketInfo) parse(m unix.SocketControlMessage) {
+	switch {
+	case m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_PKTINFO &&
+		len(m.Data) >= unix.SizeofInet4Pktinfo:
+		pi := (*unix.Inet4Pktinfo)(unsafe.Pointer(&m.Data[0]))
+		info.IfIndex = int(pi.Ifindex)
+		info.Destination = netip.AddrFrom4(pi.Addr)
+
+	case m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == unix.IPV6_PKTINFO &&
+		len(m.Data) >= unix.SizeofInet6Pktinfo:
+		pi := (*unix.Inet6Pktinfo)(unsafe.Pointer(&m.Data[0]))
+		info.IfIndex = int(pi.Ifindex)
+		info.Destination = netip.AddrFrom16(pi.Addr)
+
+	case (m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_TTL ||
+		m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == unix.IPV6_HOPLIMIT) &&
+		len(m.Data) >= 4:
+		info.TTL = int(*(*int32)(unsafe.Pointer(&m.Data[0])))
+
+	case m.Header.Level == unix.SOL_SOCKET && m.Header.Type == unix.SCM_TIMESTAMPNS &&
+		len(m.Data) >= int(unsafe.Sizeof(unix.Timespec{})):
+		ts := (*unix.Timespec)(unsafe.Pointer(&m.Data[0]))
+		info.Timestamp = time.Unix(ts.Unix())
+	}
+}
@@ -0,0 +1,120 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"errors"
+)
+
+// packetPool returns IF.Pool, creating a pool sized for the interface
+// when it is not set.
+func (IF *Interface) packetPool() *PacketPool {
+	if IF.Pool != nil {
+		return IF.Pool
+	}
+
+	size := 1500
+	if IF.MTU > 0 {
+		size = int(IF.MTU)
+	}
+	if IF.TAP {
+		size += 14
+	}
+	if IF.VnetHdr {
+		// ReceivePacket reports the size as an uint16, the kernel keeps
+		// GSO packets small enough to fit with the virtio header
+		size = 0xffff
+	}
+
+	IF.Pool = NewPacketPool(size, DefaultHeadroom)
+	return IF.Pool
+}
+
+// ReceivePacket reads a packet into a buffer from IF.Pool. It blocks until
+// a packet arrives, the buffer must be returned with ReleaseReceivePacket.
+// This is the same buffer lifecycle as the wintun based version on windows.
+func (IF *Interface) ReceivePacket() (packet []byte, size uint16, err error) {
+	T, ok := IF.RWC.(*TunFile)
+	if !ok {
+		return nil, 0, errors.New("interface is not open")
+	}
+
+	p := IF.packetPool().Get()
+	if err = T.ReadPacket(p); err != nil {
+		p.Release()
+		return nil, 0, err
+	}
+	if len(p.Data) > 0xffff {
+		p.Release()
+		return nil, 0, ErrPacketTooLarge
+	}
+
+	IF.packets.track(p)
+	return p.Data, uint16(len(p.Data)), nil
+}
+
+// ReleaseReceivePacket returns a packet from ReceivePacket to the pool.
+func (IF *Interface) ReleaseReceivePacket(packet []byte) (err error) {
+	p, ok := IF.packets.untrack(packet)
+	if !ok {
+		return errors.New("packet was not returned by ReceivePacket")
+	}
+	return p.Release()
+}
+
+// AllocateSendPacket returns a buffer of packetSize bytes from IF.Pool,
+// it is returned to the pool by SendPacket.
+func (IF *Interface) AllocateSendPacket(packetSize int) (packet []byte, err error) {
+	pool := IF.packetPool()
+	if packetSize > pool.Size() {
+		return nil, ErrPacketTooLarge
+	}
+
+	p := pool.Get()
+	p.Data = p.Data[:packetSize]
+	IF.packets.track(p)
+	return p.Data, nil
+}
+
+// SendPacket writes a packet from AllocateSendPacket and releases it.
+func (IF *Interface) SendPacket(packet []byte) (err error) {
+	p, ok := IF.packets.untrack(packet)
+	if !ok {
+		return errors.New("packet was not returned by AllocateSendPacket")
+	}
+	defer p.Release()
+
+	_, err = IF.RWC.Write(packet)
+	return
+}
+
+// ReadPacket reads a single packet into p, replacing its data.
+func (T *TunFile) ReadPacket(p *Packet) (err error) {
+	n, err := T.Read(p.Full())
+	if err != nil {
+		p.Data = p.Data[:0]
+		return err
+	}
+	p.Data = p.Data[:n]
+	return nil
+}
+
+// WritePacket writes the data of p.
+func (T *TunFile) WritePacket(p *Packet) (err error) {
+	_, err = T.Write(p.Data)
+	return
+}
+
+// ReadPacket receives a single packet into p, replacing its data. It
+// blocks like Read, in ring mode until a frame is ready.
+func (r *RawSocket) ReadPacket(p *Packet) (err error) {
+	if r.ring != nil {
+		n, err := r.ring.Read(p.Full())
+		p.Data = p.Data[:n]
+		return err
+	}
+
+	n, err := r.RWC.Read(p.Full())
+	p.Data = p.Data[:n]
+	return err
+}
@@ -0,0 +1,476 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultRingBlockSize  = 1 << 20
+	defaultRingBlockCount = 64
+	defaultRingFrameSize  = 2048
+
+	// ringTXDataOffset is where the packet starts in a TX frame,
+	// TPACKET3_HDRLEN - sizeof(struct sockaddr_ll).
+	ringTXDataOffset = unix.SizeofTpacket3Hdr
+
+	sizeofBlockDescHdr = 8
+)
+
+// PacketRing configures the AF_PACKET mode of a RawSocket. The socket
+// captures every frame on InterfaceName into a TPACKET_V3 ring shared
+// with the kernel, and optionally sends through a TX ring.
+type PacketRing struct {
+	// BlockSize is the size of a ring block, a multiple of the page size.
+	// Defaults to 1 MiB.
+	BlockSize int
+	// BlockCount is the number of blocks in each ring, defaults to 64.
+	BlockCount int
+	// FrameSize is the size of a TX frame and the accounting unit of the
+	// RX ring, a multiple of 16. Defaults to 2048.
+	FrameSize int
+	// BlockTimeout hands a block that is not full to userspace after this
+	// long, zero uses the kernel default.
+	BlockTimeout time.Duration
+	// Protocol is the ethertype to capture, defaults to ETH_P_ALL.
+	Protocol uint16
+	// TX adds a TX ring, without it frames are sent with a send call each.
+	TX bool
+}
+
+// RingBlock is a block of frames handed over by the kernel. The frames
+// returned by Next point into the ring and stay valid until Release.
+type RingBlock struct {
+	mem    []byte
+	left   uint32
+	offset uint32
+	ring   *packetRing
+	held   bool
+}
+
+// Len returns the number of frames in the block.
+func (B *RingBlock) Len() int {
+	return int(binary.NativeEndian.Uint32(B.mem[sizeofBlockDescHdr+4:]))
+}
+
+// Next returns the next frame in the block, the ethernet header included.
+func (B *RingBlock) Next() (frame []byte, ok bool) {
+	if B.left == 0 {
+		return nil, false
+	}
+	hdr := (*unix.Tpacket3Hdr)(unsafe.Pointer(&B.mem[B.offset]))
+	start := B.offset + uint32(hdr.Mac)
+	frame = B.mem[start : start+hdr.Snaplen]
+
+	B.left--
+	B.offset += hdr.Next_offset
+	return frame, true
+}
+
+// Release hands the block back to the kernel. Every block returned by
+// ReadBlock must be released, the rings of a closed socket stay mapped
+// until the last one is.
+func (B *RingBlock) Release() {
+	R := B.ring
+	R.blockLock.Lock()
+	defer R.blockLock.Unlock()
+
+	if !B.held {
+		return
+	}
+	B.held = false
+	B.release()
+
+	R.held--
+	if R.held == 0 && R.closed {
+		R.unmap()
+	}
+}
+
+func (B *RingBlock) release() {
+	status := (*uint32)(unsafe.Pointer(&B.mem[sizeofBlockDescHdr]))
+	atomic.StoreUint32(status, unix.TP_STATUS_KERNEL)
+}
+
+func (B *RingBlock) ready() bool {
+	status := (*uint32)(unsafe.Pointer(&B.mem[sizeofBlockDescHdr]))
+	return atomic.LoadUint32(status)&unix.TP_STATUS_USER != 0
+}
+
+func (B *RingBlock) reset() {
+	B.left = uint32(B.Len())
+	B.offset = binary.NativeEndian.Uint32(B.mem[sizeofBlockDescHdr+8:])
+}
+
+// packetRing is the RWC of a RawSocket in AF_PACKET mode.
+type packetRing struct {
+	cfg  PacketRing
+	file *os.File
+	rc   syscall.RawConn
+	busy time.Duration
+	mem  []byte
+
+	blocks  []RingBlock
+	next    int
+	current *RingBlock
+
+	// blockLock guards the blocks handed out by ReadBlock, held counts
+	// them and closed delays the unmap until they are released.
+	blockLock sync.Mutex
+	held      int
+	closed    bool
+
+	tx        []byte
+	txFrames  int
+	txPerBlk  int
+	txNext    int
+	readLock  sync.Mutex
+	writeLock sync.Mutex
+}
+
+// createRing sets up the AF_PACKET socket and its rings for r.Ring.
+func (r *RawSocket) createRing() (err error) {
+	cfg := *r.Ring
+	if cfg.BlockSize == 0 {
+		cfg.BlockSize = defaultRingBlockSize
+	}
+	if cfg.BlockCount == 0 {
+		cfg.BlockCount = defaultRingBlockCount
+	}
+	if cfg.FrameSize == 0 {
+		cfg.FrameSize = defaultRingFrameSize
+	}
+	if cfg.Protocol == 0 {
+		cfg.Protocol = unix.ETH_P_ALL
+	}
+	if cfg.BlockSize%os.Getpagesize() != 0 || cfg.FrameSize%unix.TPACKET_ALIGNMENT != 0 ||
+		cfg.FrameSize > cfg.BlockSize || cfg.FrameSize <= ringTXDataOffset {
+		return errors.New("invalid ring block or frame size")
+	}
+
+	ifi, err := net.InterfaceByName(r.InterfaceName)
+	if err != nil {
+		return err
+	}
+
+	proto := htons(cfg.Protocol)
+	fd, err := syscall.Socket(
+		syscall.AF_PACKET,
+		syscall.SOCK_RAW|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC,
+		int(proto),
+	)
+	if err != nil {
+		return err
+	}
+
+	if err = syscall.SetsockoptInt(fd, syscall.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	req := unix.TpacketReq3{
+		Block_size:     uint32(cfg.BlockSize),
+		Block_nr:       uint32(cfg.BlockCount),
+		Frame_size:     uint32(cfg.FrameSize),
+		Frame_nr:       uint32(cfg.BlockSize / cfg.FrameSize * cfg.BlockCount),
+		Retire_blk_tov: uint32(cfg.BlockTimeout.Milliseconds()),
+	}
+	if err = unix.SetsockoptTpacketReq3(fd, syscall.SOL_PACKET, unix.PACKET_RX_RING, &req); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	size := cfg.BlockSize * cfg.BlockCount
+	if cfg.TX {
+		req.Retire_blk_tov = 0
+		if err = unix.SetsockoptTpacketReq3(fd, syscall.SOL_PACKET, unix.PACKET_TX_RING, &req); err != nil {
+			syscall.Close(fd)
+			return err
+		}
+		size *= 2
+	}
+
+	mem, err := syscall.Mmap(fd, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_LOCKED)
+	if err != nil {
+		// MAP_LOCKED needs RLIMIT_MEMLOCK, the ring works without it
+		mem, err = syscall.Mmap(fd, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	if err = syscall.Bind(fd, &syscall.SockaddrLinklayer{
+		Protocol: proto,
+		Ifindex:  ifi.Index,
+	}); err != nil {
+		syscall.Munmap(mem)
+		syscall.Close(fd)
+		return err
+	}
+
+	ring := &packetRing{
+		cfg:    cfg,
+		file:   os.NewFile(uintptr(fd), "packet_"+r.InterfaceName),
+		busy:   r.BusyPoll,
+		mem:    mem,
+		blocks: make([]RingBlock, cfg.BlockCount),
+	}
+	if ring.rc, err = ring.file.SyscallConn(); err != nil {
+		ring.Close()
+		return err
+	}
+	for i := range ring.blocks {
+		ring.blocks[i] = RingBlock{
+			mem:  mem[i*cfg.BlockSize : (i+1)*cfg.BlockSize],
+			ring: ring,
+		}
+	}
+	if cfg.TX {
+		ring.tx = mem[cfg.BlockSize*cfg.BlockCount:]
+		ring.txPerBlk = cfg.BlockSize / cfg.FrameSize
+		ring.txFrames = ring.txPerBlk * cfg.BlockCount
+	}
+
+	r.fd = fd
+	r.file = ring.file
+	r.rc = ring.rc
+	r.ring = ring
+	r.RWC = ring
+	return nil
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// ReadBlock waits for the next block of frames from the RX ring. Frames
+// are read without copying, the block must be released before the
+// kernel can fill it again.
+func (r *RawSocket) ReadBlock() (block *RingBlock, err error) {
+	if r.ring == nil {
+		return nil, errors.New("socket is not in ring mode")
+	}
+	return r.ring.holdBlock()
+}
+
+// holdBlock reads the next block for ReadBlock and counts it as held
+// until it is released.
+func (R *packetRing) holdBlock() (block *RingBlock, err error) {
+	R.readLock.Lock()
+	defer R.readLock.Unlock()
+
+	if block, err = R.readBlock(); err != nil {
+		return nil, err
+	}
+
+	R.blockLock.Lock()
+	if !block.held {
+		block.held = true
+		R.held++
+	}
+	R.blockLock.Unlock()
+	return block, nil
+}
+
+func (R *packetRing) readBlock() (block *RingBlock, err error) {
+	block = &R.blocks[R.next]
+	err = pollRead(R.rc, R.busy, func(int) bool {
+		return block.ready()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	R.next = (R.next + 1) % len(R.blocks)
+	block.reset()
+	return block, nil
+}
+
+// Read copies the next frame from the RX ring into data.
+func (R *packetRing) Read(data []byte) (n int, err error) {
+	R.readLock.Lock()
+	defer R.readLock.Unlock()
+
+	for {
+		if R.current != nil {
+			if frame, ok := R.current.Next(); ok {
+				return copy(data, frame), nil
+			}
+			R.current.release()
+			R.current = nil
+		}
+		if R.current, err = R.readBlock(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// readBatch copies frames into bufs, it waits for the first block only.
+func (R *packetRing) readBatch(bufs [][]byte, sizes []int) (n int, err error) {
+	R.readLock.Lock()
+	defer R.readLock.Unlock()
+
+	for n < len(bufs) {
+		if R.current != nil {
+			if frame, ok := R.current.Next(); ok {
+				sizes[n] = copy(bufs[n], frame)
+				n++
+				continue
+			}
+			R.current.release()
+			R.current = nil
+		}
+		if n > 0 && !R.blocks[R.next].ready() {
+			break
+		}
+		if R.current, err = R.readBlock(); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// Write sends a single frame, through the TX ring when there is one.
+func (R *packetRing) Write(data []byte) (n int, err error) {
+	if _, err = R.writeBatch([][]byte{data}); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// writeBatch queues every frame on the TX ring and flushes them with a
+// single send call. Without a TX ring each frame is sent on its own.
+func (R *packetRing) writeBatch(bufs [][]byte) (n int, err error) {
+	R.writeLock.Lock()
+	defer R.writeLock.Unlock()
+
+	if R.tx == nil {
+		werr := R.rc.Write(func(fd uintptr) bool {
+			for n < len(bufs) {
+				_, e := syscall.Write(int(fd), bufs[n])
+				if e == syscall.EAGAIN {
+					return false
+				}
+				if e != nil {
+					err = os.NewSyscallError("write", e)
+					return true
+				}
+				n++
+			}
+			return true
+		})
+		if err == nil {
+			err = werr
+		}
+		return n, err
+	}
+
+	for _, b := range bufs {
+		if len(b) > R.cfg.FrameSize-ringTXDataOffset {
+			return 0, ErrPacketTooLarge
+		}
+	}
+
+	werr := R.rc.Write(func(fd uintptr) bool {
+		queued := 0
+		for n+queued < len(bufs) {
+			frame := R.txFrame(R.txNext)
+			hdr := (*unix.Tpacket3Hdr)(unsafe.Pointer(&frame[0]))
+			if atomic.LoadUint32(&hdr.Status) != unix.TP_STATUS_AVAILABLE {
+				break
+			}
+
+			b := bufs[n+queued]
+			copy(frame[ringTXDataOffset:], b)
+			hdr.Next_offset = 0
+			hdr.Len = uint32(len(b))
+			hdr.Snaplen = uint32(len(b))
+			atomic.StoreUint32(&hdr.Status, unix.TP_STATUS_SEND_REQUEST)
+
+			R.txNext = (R.txNext + 1) % R.txFrames
+			queued++
+		}
+
+		if queued > 0 {
+			if _, _, e := syscall.Syscall6(syscall.SYS_SENDTO, fd, 0, 0, 0, 0, 0); e != 0 && e != syscall.EAGAIN {
+				err = os.NewSyscallError("sendto", e)
+				return true
+			}
+			n += queued
+		}
+
+		// wait for the kernel to free frames when the ring is full
+		return n == len(bufs)
+	})
+	if err == nil {
+		err = rawConnErr(werr)
+	}
+	return n, err
+}
+
+func (R *packetRing) txFrame(i int) []byte {
+	block := i / R.txPerBlk
+	offset := block*R.cfg.BlockSize + (i%R.txPerBlk)*R.cfg.FrameSize
+	return R.tx[offset : offset+R.cfg.FrameSize]
+}
+
+// Close unblocks readers and writers, closes the socket and unmaps the
+// rings. Blocks from ReadBlock that are not released yet keep the rings
+// mapped until they are.
+func (R *packetRing) Close() (err error) {
+	err = R.file.Close()
+
+	R.readLock.Lock()
+	R.writeLock.Lock()
+	defer R.readLock.Unlock()
+	defer R.writeLock.Unlock()
+
+	R.blockLock.Lock()
+	defer R.blockLock.Unlock()
+
+	R.closed = true
+	if R.held == 0 {
+		R.unmap()
+	}
+	return err
+}
+
+func (R *packetRing) unmap() {
+	if R.mem != nil {
+		syscall.Munmap(R.mem)
+		R.mem = nil
+	}
+}
+
+// RingStats returns the number of frames received and dropped by the RX
+// ring since the last call, and how often the ring was full.
+func (r *RawSocket) RingStats() (packets uint32, drops uint32, freezes uint32, err error) {
+	if r.ring == nil {
+		return 0, 0, 0, errors.New("socket is not in ring mode")
+	}
+
+	cerr := r.ring.rc.Control(func(fd uintptr) {
+		var s *unix.TpacketStatsV3
+		s, err = unix.GetsockoptTpacketStatsV3(int(fd), syscall.SOL_PACKET, unix.PACKET_STATISTICS)
+		if err == nil {
+			packets, drops, freezes = s.Packets, s.Drops, s.Freeze_q_cnt
+		}
+	})
+	if cerr != nil {
+		err = rawConnErr(cerr)
+	}
+	return
+}
@@ -0,0 +1,453 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"errors"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Route is a single entry in a kernel routing table.
+type Route struct {
+	Dst     netip.Prefix
+	Gateway netip.Addr
+	// Src is the preferred source address for packets using the route.
+	Src netip.Addr
+	// Interface is the name of the output interface, Index can be used
+	// instead when the index is already known.
+	Interface string
+	Index     int
+	Metric    uint32
+	// Table defaults to the main table.
+	Table uint32
+	// Protocol defaults to RTPROT_BOOT, same as ip route.
+	Protocol uint8
+	// Scope defaults to link scope for routes without a gateway.
+	Scope uint8
+	// Type defaults to RTN_UNICAST.
+	Type uint8
+	MTU  uint32
+}
+
+// Route tables, protocols and types for Route.
+const (
+	TableMain    = unix.RT_TABLE_MAIN
+	TableLocal   = unix.RT_TABLE_LOCAL
+	TableDefault = unix.RT_TABLE_DEFAULT
+
+	ProtocolBoot   = unix.RTPROT_BOOT
+	ProtocolKernel = unix.RTPROT_KERNEL
+	ProtocolStatic = unix.RTPROT_STATIC
+
+	RouteTypeUnicast     = unix.RTN_UNICAST
+	RouteTypeLocal       = unix.RTN_LOCAL
+	RouteTypeBlackhole   = unix.RTN_BLACKHOLE
+	RouteTypeUnreachable = unix.RTN_UNREACHABLE
+	RouteTypeProhibit    = unix.RTN_PROHIBIT
+	RouteTypeThrow       = unix.RTN_THROW
+)
+
+// RouteAdd adds r, it fails with ErrExists if the route already exists.
+func RouteAdd(r Route) (err error) {
+	return changeRoute(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, r)
+}
+
+// RouteReplace adds r or replaces the existing route with the same
+// destination, table, metric and type.
+func RouteReplace(r Route) (err error) {
+	return changeRoute(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, r)
+}
+
+// RouteDel removes r, it fails with ErrNotFound if there is no such route.
+// Fields that are not set match any route, except Table which defaults to
+// the main table as it does for RouteAdd.
+func RouteDel(r Route) (err error) {
+	return changeRoute(unix.RTM_DELROUTE, 0, r)
+}
+
+// RouteList returns the routes of the given family (AF_INET, AF_INET6 or
+// AF_UNSPEC for both) in table, a table of 0 returns routes from every table.
+// RouteList(syscall.AF_UNSPEC, 0) dumps every route on the system.
+func RouteList(family int, table uint32) (routes []Route, err error) {
+	rtm := unix.RtMsg{Family: uint8(family)}
+	m := newNetlinkMessage(unix.RTM_GETROUTE, unix.NLM_F_DUMP, unsafe.Pointer(&rtm), unix.SizeofRtMsg)
+
+	replies, err := netlinkExecute("getroute", m)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := linkNames()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, reply := range replies {
+		r, ok := parseRoute(reply)
+		if !ok {
+			continue
+		}
+		if table != 0 && r.Table != table {
+			continue
+		}
+		r.Interface = names[r.Index]
+		routes = append(routes, r)
+	}
+
+	return
+}
+
+func parseRoute(b []byte) (r Route, ok bool) {
+	if len(b) < unix.SizeofRtMsg {
+		return r, false
+	}
+	rtm := (*unix.RtMsg)(unsafe.Pointer(&b[0]))
+	attrs := parseNetlinkAttrs(b[unix.SizeofRtMsg:])
+
+	r.Table = uint32(rtm.Table)
+	if attrs.get(unix.RTA_TABLE) != nil {
+		r.Table = attrs.uint32(unix.RTA_TABLE)
+	}
+	r.Protocol = rtm.Protocol
+	r.Scope = rtm.Scope
+	r.Type = rtm.Type
+	r.Index = int(attrs.uint32(unix.RTA_OIF))
+	r.Metric = attrs.uint32(unix.RTA_PRIORITY)
+
+	if dst, ok := netip.AddrFromSlice(attrs.get(unix.RTA_DST)); ok {
+		r.Dst = netip.PrefixFrom(dst, int(rtm.Dst_len))
+	} else if rtm.Family == syscall.AF_INET {
+		r.Dst = netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+	} else if rtm.Family == syscall.AF_INET6 {
+		r.Dst = netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+	} else {
+		return r, false
+	}
+
+	r.Gateway, _ = netip.AddrFromSlice(attrs.get(unix.RTA_GATEWAY))
+	r.Src, _ = netip.AddrFromSlice(attrs.get(unix.RTA_PREFSRC))
+
+	r.MTU = parseNetlinkAttrs(attrs.get(unix.RTA_METRICS)).uint32(unix.RTAX_MTU)
+
+	return r, true
+}
+
+func changeRoute(msgType uint16, flags uint16, r Route) (err error) {
+	if !r.Dst.IsValid() {
+		return errors.New("invalid route destination")
+	}
+	dst := r.Dst.Masked()
+
+	rtm := unix.RtMsg{
+		Family:   syscall.AF_INET,
+		Dst_len:  uint8(dst.Bits()),
+		Table:    unix.RT_TABLE_MAIN,
+		Protocol: r.Protocol,
+		Scope:    r.Scope,
+		Type:     r.Type,
+	}
+	if dst.Addr().Is6() {
+		rtm.Family = syscall.AF_INET6
+	}
+
+	table := r.Table
+	if table == 0 {
+		table = unix.RT_TABLE_MAIN
+	}
+	if table < 256 {
+		rtm.Table = uint8(table)
+	} else {
+		rtm.Table = unix.RT_TABLE_COMPAT
+	}
+
+	if msgType == unix.RTM_NEWROUTE {
+		if rtm.Protocol == 0 {
+			rtm.Protocol = unix.RTPROT_BOOT
+		}
+		if rtm.Type == 0 {
+			rtm.Type = unix.RTN_UNICAST
+		}
+		if rtm.Scope == 0 && !r.Gateway.IsValid() && rtm.Type == unix.RTN_UNICAST {
+			rtm.Scope = unix.RT_SCOPE_LINK
+		}
+	} else {
+		rtm.Scope = unix.RT_SCOPE_NOWHERE
+		if r.Scope != 0 {
+			rtm.Scope = r.Scope
+		}
+	}
+
+	index := r.Index
+	if index == 0 && r.Interface != "" {
+		if index, err = linkIndex(r.Interface); err != nil {
+			return err
+		}
+	}
+
+	m := newNetlinkMessage(msgType, flags, unsafe.Pointer(&rtm), unix.SizeofRtMsg)
+	m.addAttr(unix.RTA_DST, dst.Addr().AsSlice())
+	m.addUint32(unix.RTA_TABLE, table)
+
+	if r.Gateway.IsValid() {
+		gw := r.Gateway.Unmap()
+		if gw.Is4() != dst.Addr().Is4() {
+			return errors.New("gateway and destination must be the same address family")
+		}
+		m.addAttr(unix.RTA_GATEWAY, gw.AsSlice())
+	}
+	if r.Src.IsValid() {
+		m.addAttr(unix.RTA_PREFSRC, r.Src.Unmap().AsSlice())
+	}
+	if index != 0 {
+		m.addUint32(unix.RTA_OIF, uint32(index))
+	}
+	if r.Metric != 0 {
+		m.addUint32(unix.RTA_PRIORITY, r.Metric)
+	}
+	if r.MTU != 0 {
+		m.nest(unix.RTA_METRICS, func() {
+			m.addUint32(unix.RTAX_MTU, r.MTU)
+		})
+	}
+
+	e, journaled := netJournalEntry(JournalRoute)
+	e.Route = &r
+	if msgType == unix.RTM_DELROUTE {
+		if _, err = netlinkExecute("delroute", m); err != nil || !journaled {
+			return err
+		}
+		return journalRevert(e)
+	}
+
+	add := func() error {
+		_, err := netlinkExecute("newroute", m)
+		return err
+	}
+	if !journaled {
+		return add()
+	}
+	if flags&unix.NLM_F_REPLACE != 0 {
+		if e.Replaced, err = replacedRoute(r); err != nil {
+			return err
+		}
+	}
+	return journalChange(e, add)
+}
+
+// replacedRoute returns the route RouteReplace(r) would replace, nil when
+// there is none.
+func replacedRoute(r Route) (old *Route, err error) {
+	family := syscall.AF_INET
+	if r.Dst.Addr().Is6() {
+		family = syscall.AF_INET6
+	}
+	table := r.Table
+	if table == 0 {
+		table = unix.RT_TABLE_MAIN
+	}
+
+	routes, err := RouteList(family, table)
+	if err != nil {
+		return nil, err
+	}
+	key := routeKey(r)
+	for i := range routes {
+		if routeKey(routes[i]) == key {
+			old = &routes[i]
+			// the index changes when the link is recreated, the name does not
+			if old.Interface != "" {
+				old.Index = 0
+			}
+			return old, nil
+		}
+	}
+	return nil, nil
+}
+
+// parseRouteArgs converts the string arguments used by IP_AddRoute and
+// IP_DelRoute into a Route. A network of "default" is the IPv4 default
+// route, or the IPv6 one when the gateway is an IPv6 address, same as ip
+// route.
+func parseRouteArgs(network string, gateway string, metric string) (r Route, err error) {
+	if gateway != "" {
+		if r.Gateway, err = netip.ParseAddr(gateway); err != nil {
+			return r, err
+		}
+	}
+
+	switch network {
+	case "default":
+		r.Dst = netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+		if r.Gateway.Unmap().Is6() {
+			r.Dst = netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+		}
+	case "default6":
+		r.Dst = netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+	default:
+		r.Dst, err = netip.ParsePrefix(network)
+		if err != nil {
+			ip, perr := netip.ParseAddr(network)
+			if perr != nil {
+				return r, err
+			}
+			r.Dst = netip.PrefixFrom(ip, ip.BitLen())
+		}
+	}
+
+	if metric != "" {
+		m, err := strconv.ParseUint(metric, 10, 32)
+		if err != nil {
+			return r, err
+		}
+		r.Metric = uint32(m)
+	}
+
+	return r, nil
+}
+
+// linkNames maps interface indexes to names.
+func linkNames() (names map[int]string, err error) {
+	var ifi unix.IfInfomsg
+	m := newNetlinkMessage(unix.RTM_GETLINK, unix.NLM_F_DUMP, unsafe.Pointer(&ifi), unix.SizeofIfInfomsg)
+
+	replies, err := netlinkExecute("getlink", m)
+	if err != nil {
+		return nil, err
+	}
+
+	names = make(map[int]string)
+	for _, r := range replies {
+		if len(r) < unix.SizeofIfInfomsg {
+			continue
+		}
+		msg := (*unix.IfInfomsg)(unsafe.Pointer(&r[0]))
+		names[int(msg.Index)] = parseNetlinkAttrs(r[unix.SizeofIfInfomsg:]).string(unix.IFLA_IFNAME)
+	}
+
+	return
+}
+
+// RouteQuery describes a route lookup, only Dst is required.
+type RouteQuery struct {
+	Dst netip.Addr
+	Src netip.Addr
+	// Mark is the fwmark of the packet, used by policy rules.
+	Mark uint32
+	// Interface forces the lookup to a specific output interface.
+	Interface string
+}
+
+// RouteGet returns the route the kernel would use to reach dst, same as
+// ip route get. Interface, Gateway, Src and MTU are filled in from the
+// lookup, MTU falls back to the MTU of the output interface. Metric is
+// the metric of the matching route in the routing table.
+func RouteGet(dst netip.Addr) (r Route, err error) {
+	return RouteLookup(RouteQuery{Dst: dst})
+}
+
+// RouteLookup is RouteGet with control over the source address, fwmark
+// and output interface of the lookup.
+func RouteLookup(q RouteQuery) (r Route, err error) {
+	if !q.Dst.IsValid() {
+		return r, errors.New("invalid route destination")
+	}
+	dst := q.Dst.Unmap()
+
+	index := 0
+	if q.Interface != "" {
+		if index, err = linkIndex(q.Interface); err != nil {
+			return r, err
+		}
+	}
+
+	r, err = routeLookup(q, dst, index, 0)
+	if err != nil {
+		return r, err
+	}
+
+	// the resolved route carries no metric, a lookup with RTM_F_FIB_MATCH
+	// returns the table entry it came from instead
+	match, err := routeLookup(q, dst, index, unix.RTM_F_FIB_MATCH)
+	if err != nil {
+		return r, err
+	}
+	r.Metric = match.Metric
+
+	if r.Index != 0 {
+		var mtu uint32
+		r.Interface, mtu, err = linkByIndex(r.Index)
+		if err != nil {
+			return r, err
+		}
+		if r.MTU == 0 {
+			r.MTU = mtu
+		}
+	}
+
+	return r, nil
+}
+
+// routeLookup sends a single RTM_GETROUTE request for q with the given
+// rtm flags.
+func routeLookup(q RouteQuery, dst netip.Addr, index int, flags uint32) (r Route, err error) {
+	rtm := unix.RtMsg{
+		Family:  syscall.AF_INET,
+		Dst_len: uint8(dst.BitLen()),
+		Flags:   flags,
+	}
+	if dst.Is6() {
+		rtm.Family = syscall.AF_INET6
+	}
+
+	if q.Src.IsValid() {
+		rtm.Src_len = uint8(q.Src.Unmap().BitLen())
+	}
+
+	m := newNetlinkMessage(unix.RTM_GETROUTE, 0, unsafe.Pointer(&rtm), unix.SizeofRtMsg)
+	m.addAttr(unix.RTA_DST, dst.AsSlice())
+	if q.Src.IsValid() {
+		m.addAttr(unix.RTA_SRC, q.Src.Unmap().AsSlice())
+	}
+	if q.Mark != 0 {
+		m.addUint32(unix.RTA_MARK, q.Mark)
+	}
+	if index != 0 {
+		m.addUint32(unix.RTA_OIF, uint32(index))
+	}
+
+	replies, err := netlinkExecute("getroute", m)
+	if err != nil {
+		return r, err
+	}
+	if len(replies) == 0 {
+		return r, &NetlinkError{Op: "getroute", Errno: syscall.ENETUNREACH}
+	}
+
+	r, ok := parseRoute(replies[0])
+	if !ok {
+		return r, errors.New("invalid route reply")
+	}
+	return r, nil
+}
+
+// linkByIndex returns the name and MTU of a link.
+func linkByIndex(index int) (name string, mtu uint32, err error) {
+	ifi := unix.IfInfomsg{Index: int32(index)}
+	m := newNetlinkMessage(unix.RTM_GETLINK, 0, unsafe.Pointer(&ifi), unix.SizeofIfInfomsg)
+
+	replies, err := netlinkExecute("getlink", m)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(replies) == 0 || len(replies[0]) < unix.SizeofIfInfomsg {
+		return "", 0, &NetlinkError{Op: "getlink", Errno: syscall.ENODEV}
+	}
+
+	attrs := parseNetlinkAttrs(replies[0][unix.SizeofIfInfomsg:])
+	return attrs.string(unix.IFLA_IFNAME), attrs.uint32(unix.IFLA_MTU), nil
+}
@@ -0,0 +1,345 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fibRuleHdr is the fib_rule_hdr from linux/fib_rules.h
+type fibRuleHdr struct {
+	Family uint8
+	DstLen uint8
+	SrcLen uint8
+	TOS    uint8
+	Table  uint8
+	Res1   uint8
+	Res2   uint8
+	Action uint8
+	Flags  uint32
+}
+
+const sizeofFibRuleHdr = 12
+
+// Rule is a policy routing rule, see ip-rule(8).
+type Rule struct {
+	// Family is AF_INET or AF_INET6, it is taken from Src or Dst when
+	// one of them is set and defaults to AF_INET.
+	Family   int
+	Priority uint32
+	Table    uint32
+	Src      netip.Prefix
+	Dst      netip.Prefix
+	// Mark and Mask match the fwmark of the packet, Mask defaults to
+	// 0xffffffff when Mark is set.
+	Mark uint32
+	Mask uint32
+	IIF  string
+	OIF  string
+	// UIDStart and UIDEnd match the uid of the socket owner when UIDEnd
+	// is set.
+	UIDStart uint32
+	UIDEnd   uint32
+	// Invert turns the rule into a "not" rule.
+	Invert bool
+	// Suppress enables suppress_prefixlength, routes with a prefix length
+	// of SuppressPrefixLength or less found by this rule are ignored.
+	Suppress             bool
+	SuppressPrefixLength uint32
+	// Action defaults to FR_ACT_TO_TBL.
+	Action uint8
+}
+
+// RuleAdd adds r, it fails with ErrExists if an identical rule exists.
+func RuleAdd(r Rule) (err error) {
+	return changeRule(unix.RTM_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, r)
+}
+
+// RuleDel removes the first rule that matches r.
+func RuleDel(r Rule) (err error) {
+	return changeRule(unix.RTM_DELRULE, 0, r)
+}
+
+// RuleList returns the rules for family, AF_UNSPEC returns both families.
+func RuleList(family int) (rules []Rule, err error) {
+	hdr := fibRuleHdr{Family: uint8(family)}
+	m := newNetlinkMessage(unix.RTM_GETRULE, unix.NLM_F_DUMP, unsafe.Pointer(&hdr), sizeofFibRuleHdr)
+
+	replies, err := netlinkExecute("getrule", m)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, reply := range replies {
+		if len(reply) < sizeofFibRuleHdr {
+			continue
+		}
+		// multicast routing rules are dumped as well, skip them
+		if reply[0] != syscall.AF_INET && reply[0] != syscall.AF_INET6 {
+			continue
+		}
+		rules = append(rules, parseRule(reply))
+	}
+
+	return
+}
+
+func parseRule(b []byte) (r Rule) {
+	hdr := (*fibRuleHdr)(unsafe.Pointer(&b[0]))
+	attrs := parseNetlinkAttrs(b[sizeofFibRuleHdr:])
+
+	r.Family = int(hdr.Family)
+	r.Action = hdr.Action
+	r.Invert = hdr.Flags&unix.FIB_RULE_INVERT != 0
+	r.Table = uint32(hdr.Table)
+	if attrs.get(unix.FRA_TABLE) != nil {
+		r.Table = attrs.uint32(unix.FRA_TABLE)
+	}
+	r.Priority = attrs.uint32(unix.FRA_PRIORITY)
+	r.Mark = attrs.uint32(unix.FRA_FWMARK)
+	r.Mask = attrs.uint32(unix.FRA_FWMASK)
+	r.IIF = attrs.string(unix.FRA_IIFNAME)
+	r.OIF = attrs.string(unix.FRA_OIFNAME)
+
+	if src, ok := netip.AddrFromSlice(attrs.get(unix.FRA_SRC)); ok {
+		r.Src = netip.PrefixFrom(src, int(hdr.SrcLen))
+	}
+	if dst, ok := netip.AddrFromSlice(attrs.get(unix.FRA_DST)); ok {
+		r.Dst = netip.PrefixFrom(dst, int(hdr.DstLen))
+	}
+	if uid := attrs.get(unix.FRA_UID_RANGE); len(uid) >= 8 {
+		r.UIDStart = binary.NativeEndian.Uint32(uid[0:])
+		r.UIDEnd = binary.NativeEndian.Uint32(uid[4:])
+		// the kernel reports every rule with the full uid range
+		if r.UIDStart == 0 && r.UIDEnd == 0xffffffff {
+			r.UIDStart, r.UIDEnd = 0, 0
+		}
+	}
+	if v := attrs.get(unix.FRA_SUPPRESS_PREFIXLEN); len(v) >= 4 {
+		if plen := binary.NativeEndian.Uint32(v); plen != 0xffffffff {
+			r.Suppress = true
+			r.SuppressPrefixLength = plen
+		}
+	}
+
+	return
+}
+
+func changeRule(msgType uint16, flags uint16, r Rule) (err error) {
+	hdr := fibRuleHdr{
+		Family: syscall.AF_INET,
+		Action: r.Action,
+	}
+
+	switch {
+	case r.Family != 0:
+		hdr.Family = uint8(r.Family)
+	case r.Src.IsValid() && r.Src.Addr().Is6():
+		hdr.Family = syscall.AF_INET6
+	case r.Dst.IsValid() && r.Dst.Addr().Is6():
+		hdr.Family = syscall.AF_INET6
+	}
+
+	if hdr.Action == 0 {
+		hdr.Action = unix.FR_ACT_TO_TBL
+	}
+	if r.Invert {
+		hdr.Flags |= unix.FIB_RULE_INVERT
+	}
+
+	table := r.Table
+	if table == 0 && msgType == unix.RTM_NEWRULE && hdr.Action == unix.FR_ACT_TO_TBL {
+		table = unix.RT_TABLE_MAIN
+	}
+	if table != 0 && table < 256 {
+		hdr.Table = uint8(table)
+	}
+
+	if r.Src.IsValid() {
+		hdr.SrcLen = uint8(r.Src.Bits())
+	}
+	if r.Dst.IsValid() {
+		hdr.DstLen = uint8(r.Dst.Bits())
+	}
+
+	m := newNetlinkMessage(msgType, flags, unsafe.Pointer(&hdr), sizeofFibRuleHdr)
+
+	if table != 0 {
+		m.addUint32(unix.FRA_TABLE, table)
+	}
+	if r.Priority != 0 {
+		m.addUint32(unix.FRA_PRIORITY, r.Priority)
+	}
+	if r.Src.IsValid() {
+		m.addAttr(unix.FRA_SRC, r.Src.Masked().Addr().AsSlice())
+	}
+	if r.Dst.IsValid() {
+		m.addAttr(unix.FRA_DST, r.Dst.Masked().Addr().AsSlice())
+	}
+	if r.Mark != 0 || r.Mask != 0 {
+		mask := r.Mask
+		if mask == 0 {
+			mask = 0xffffffff
+		}
+		m.addUint32(unix.FRA_FWMARK, r.Mark)
+		m.addUint32(unix.FRA_FWMASK, mask)
+	}
+	if r.IIF != "" {
+		m.addString(unix.FRA_IIFNAME, r.IIF)
+	}
+	if r.OIF != "" {
+		m.addString(unix.FRA_OIFNAME, r.OIF)
+	}
+	if r.UIDEnd != 0 {
+		if r.UIDEnd < r.UIDStart {
+			return errors.New("invalid uid range")
+		}
+		uid := make([]byte, 8)
+		binary.NativeEndian.PutUint32(uid[0:], r.UIDStart)
+		binary.NativeEndian.PutUint32(uid[4:], r.UIDEnd)
+		m.addAttr(unix.FRA_UID_RANGE, uid)
+	}
+	if r.Suppress {
+		m.addUint32(unix.FRA_SUPPRESS_PREFIXLEN, r.SuppressPrefixLength)
+	}
+
+	e, journaled := netJournalEntry(JournalRule)
+	e.Rule = &r
+	if msgType == unix.RTM_DELRULE {
+		if _, err = netlinkExecute("delrule", m); err != nil || !journaled {
+			return err
+		}
+		return journalRevert(e)
+	}
+
+	add := func() error {
+		_, err := netlinkExecute("newrule", m)
+		return err
+	}
+	if !journaled {
+		return add()
+	}
+	return journalChange(e, add)
+}
+
+// SetSocketMark sets the fwmark on a socket, packets sent on it can then
+// be matched with Rule.Mark.
+func SetSocketMark(fd int, mark uint32) (err error) {
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, int(mark))
+}
+
+// FullTunnel sends all traffic through Interface, except traffic marked
+// with Mark which keeps using the main routing table. The transport
+// socket of the tunnel should be marked with SetSocketMark.
+//
+// It installs a default route in Table and two rules for each family:
+//
+//	Priority:   lookup main suppress_prefixlength 0
+//	Priority+1: not fwmark Mark lookup Table
+type FullTunnel struct {
+	Interface string
+	Table     uint32
+	Mark      uint32
+	// Priority defaults to 32000.
+	Priority uint32
+	IPv4     bool
+	IPv6     bool
+
+	routes []Route
+	rules  []Rule
+}
+
+// Up installs the routes and rules, anything installed before an error
+// is removed again.
+func (F *FullTunnel) Up() (err error) {
+	if F.Table == 0 || F.Mark == 0 {
+		return errors.New("table and mark are required")
+	}
+	if F.Priority == 0 {
+		F.Priority = 32000
+	}
+
+	var families []int
+	if F.IPv4 {
+		families = append(families, syscall.AF_INET)
+	}
+	if F.IPv6 {
+		families = append(families, syscall.AF_INET6)
+	}
+	if len(families) == 0 {
+		return errors.New("IPv4 or IPv6 is required")
+	}
+
+	for _, family := range families {
+		dst := netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+		if family == syscall.AF_INET6 {
+			dst = netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+		}
+
+		route := Route{
+			Dst:       dst,
+			Interface: F.Interface,
+			Table:     F.Table,
+		}
+		if err = RouteReplace(route); err != nil {
+			F.Down()
+			return err
+		}
+		F.routes = append(F.routes, route)
+
+		rules := []Rule{
+			{
+				Family:   family,
+				Priority: F.Priority,
+				Table:    unix.RT_TABLE_MAIN,
+				Suppress: true,
+			},
+			{
+				Family:   family,
+				Priority: F.Priority + 1,
+				Table:    F.Table,
+				Mark:     F.Mark,
+				Invert:   true,
+			},
+		}
+		for _, rule := range rules {
+			// a rule that is already there is not ours to remove in Down
+			err = RuleAdd(rule)
+			if errors.Is(err, ErrExists) {
+				continue
+			}
+			if err != nil {
+				F.Down()
+				return err
+			}
+			F.rules = append(F.rules, rule)
+		}
+	}
+
+	return nil
+}
+
+// Down removes every rule and route installed by Up.
+func (F *FullTunnel) Down() (err error) {
+	var errs []error
+	for i := len(F.rules) - 1; i >= 0; i-- {
+		if rerr := RuleDel(F.rules[i]); rerr != nil && !errors.Is(rerr, ErrNotFound) {
+			errs = append(errs, rerr)
+		}
+	}
+	for i := len(F.routes) - 1; i >= 0; i-- {
+		if rerr := RouteDel(F.routes[i]); rerr != nil && !errors.Is(rerr, ErrNotFound) {
+			errs = append(errs, rerr)
+		}
+	}
+	F.rules = nil
+	F.routes = nil
+
+	return errors.Join(errs...)
+}
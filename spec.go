@@ -0,0 +1,404 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Spec is the desired state of an interface, see Apply. Zero values for
+// MTU and TxQueuelen leave the current setting alone.
+type Spec struct {
+	MTU        int32
+	TxQueuelen int32
+	// Up sets the link state, nil leaves it alone.
+	Up *bool
+
+	Addresses []Address
+	// Routes without Interface or Index are routed through the interface.
+	Routes []Route
+	Rules  []Rule
+
+	// Purge removes addresses, routes and rules of the interface that
+	// are not in the spec. Rules belong to the interface when they name it
+	// as IIF or OIF or look up a table, other than main, local and
+	// default, that a route in the spec uses. Link local addresses and
+	// routes added by the kernel are always kept.
+	Purge bool
+}
+
+// Action is a single change made by Apply.
+type Action struct {
+	Op     string
+	Detail string
+}
+
+func (a Action) String() string {
+	if a.Detail == "" {
+		return a.Op
+	}
+	return a.Op + " " + a.Detail
+}
+
+// Apply brings the interface to the state described by spec. The live
+// state is read from the kernel first and only the differences are
+// applied, so calling Apply again with the same spec does nothing. The
+// interface is created from the fields of IF if it does not exist.
+// Every change made, including those before an error, is returned.
+func (IF *Interface) Apply(spec Spec) (actions []Action, err error) {
+	record := func(op string, detail string) {
+		actions = append(actions, Action{Op: op, Detail: detail})
+	}
+
+	flags, attrs, err := IF.linkAttrs()
+	if errors.Is(err, ErrNotFound) {
+		if err = IF.Create(); err != nil {
+			return actions, err
+		}
+		record("create", IF.Name)
+		flags, attrs, err = IF.linkAttrs()
+	}
+	if err != nil {
+		return actions, err
+	}
+
+	if spec.MTU != 0 && uint32(spec.MTU) != attrs.uint32(unix.IFLA_MTU) {
+		IF.MTU = spec.MTU
+		if err = IF.Syscall_MTU(); err != nil {
+			return actions, err
+		}
+		record("mtu", fmt.Sprint(spec.MTU))
+	}
+
+	if spec.TxQueuelen != 0 && uint32(spec.TxQueuelen) != attrs.uint32(unix.IFLA_TXQLEN) {
+		IF.TxQueuelen = spec.TxQueuelen
+		if err = IF.Syscall_TXQueuelen(); err != nil {
+			return actions, err
+		}
+		record("txqueuelen", fmt.Sprint(spec.TxQueuelen))
+	}
+
+	if err = IF.applyAddresses(spec, record); err != nil {
+		return actions, err
+	}
+
+	// routes through a link that is down are rejected by the kernel and
+	// taking a link down flushes its routes, so the link state is settled
+	// before any route is applied
+	up := flags&syscall.IFF_UP != 0
+	if spec.Up != nil && *spec.Up && !up {
+		if err = IF.Syscall_UP(); err != nil {
+			return actions, err
+		}
+		record("up", IF.Name)
+	}
+	if spec.Up != nil && !*spec.Up && up {
+		if err = IF.Syscall_DOWN(); err != nil {
+			return actions, err
+		}
+		record("down", IF.Name)
+	}
+
+	err = IF.do(func() error {
+		if err := IF.applyRoutes(spec, record); err != nil {
+			return err
+		}
+		return IF.applyRules(spec, record)
+	})
+	if err != nil {
+		return actions, err
+	}
+
+	return actions, nil
+}
+
+// linkAttrs returns the flags and attributes of the interface.
+func (IF *Interface) linkAttrs() (flags uint32, attrs netlinkAttrs, err error) {
+	err = IF.do(func() error {
+		var ifi unix.IfInfomsg
+		m := newNetlinkMessage(unix.RTM_GETLINK, 0, unsafe.Pointer(&ifi), unix.SizeofIfInfomsg)
+		m.addString(unix.IFLA_IFNAME, IF.Name)
+
+		replies, err := netlinkExecute("getlink", m)
+		if err != nil {
+			return err
+		}
+		if len(replies) == 0 || len(replies[0]) < unix.SizeofIfInfomsg {
+			return &NetlinkError{Op: "getlink", Errno: syscall.ENODEV}
+		}
+
+		flags = (*unix.IfInfomsg)(unsafe.Pointer(&replies[0][0])).Flags
+		attrs = parseNetlinkAttrs(replies[0][unix.SizeofIfInfomsg:])
+		return nil
+	})
+	return
+}
+
+func (IF *Interface) applyAddresses(spec Spec, record func(string, string)) (err error) {
+	current, err := IF.ListAddresses()
+	if err != nil {
+		return err
+	}
+
+	for _, want := range spec.Addresses {
+		i := slices.IndexFunc(current, func(a Address) bool {
+			return a.Prefix.Addr() == want.Prefix.Addr()
+		})
+		if i >= 0 && IF.addressMatches(want, current[i]) {
+			continue
+		}
+		// the kernel does not change an address in place
+		if i >= 0 {
+			if err = IF.DelAddress(current[i]); err != nil {
+				return err
+			}
+			record("del-address", current[i].Prefix.String())
+		}
+		if err = IF.AddAddress(want); err != nil {
+			return err
+		}
+		record("add-address", want.Prefix.String())
+	}
+
+	if !spec.Purge {
+		return nil
+	}
+
+	for _, a := range current {
+		if a.Prefix.Addr().IsLinkLocalUnicast() {
+			continue
+		}
+		wanted := slices.ContainsFunc(spec.Addresses, func(want Address) bool {
+			return want.Prefix.Addr() == a.Prefix.Addr()
+		})
+		if wanted {
+			continue
+		}
+		if err = IF.DelAddress(a); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		record("del-address", a.Prefix.String())
+	}
+
+	return nil
+}
+
+// addressFlags are the IFA_F_* flags that can be set on an address, the
+// others are kept by the kernel.
+const addressFlags = unix.IFA_F_NODAD | unix.IFA_F_OPTIMISTIC | unix.IFA_F_HOMEADDRESS |
+	unix.IFA_F_MANAGETEMPADDR | unix.IFA_F_NOPREFIXROUTE | unix.IFA_F_MCAUTOJOIN
+
+// addressMatches reports whether the kernel address have is the address
+// want, with the defaults the kernel fills in. The kernel picks the scope
+// of IPv6 addresses itself, labels only IPv4 addresses and labels them
+// with the interface name by default.
+func (IF *Interface) addressMatches(want Address, have Address) bool {
+	v6 := want.Prefix.Addr().Unmap().Is6()
+
+	label := want.Label
+	if label == "" {
+		label = IF.Name
+	}
+
+	return have.Prefix == want.Prefix &&
+		have.Peer == want.Peer &&
+		(v6 || have.Label == label) &&
+		(have.Scope == want.Scope || v6 && want.Scope == 0) &&
+		have.Flags&addressFlags == want.Flags&addressFlags
+}
+
+// applyRoutes runs inside the namespace of the interface.
+func (IF *Interface) applyRoutes(spec Spec, record func(string, string)) (err error) {
+	if len(spec.Routes) == 0 && !spec.Purge {
+		return nil
+	}
+
+	index, err := linkIndex(IF.Name)
+	if err != nil {
+		return err
+	}
+
+	current, err := RouteList(syscall.AF_UNSPEC, 0)
+	if err != nil {
+		return err
+	}
+
+	var wanted []Route
+	for _, want := range spec.Routes {
+		if want.Interface == "" && want.Index == 0 {
+			want.Interface = IF.Name
+		}
+		if want.Index == 0 && want.Interface != "" {
+			if want.Index, err = linkIndex(want.Interface); err != nil {
+				return err
+			}
+		}
+		wanted = append(wanted, want)
+
+		i := slices.IndexFunc(current, func(r Route) bool {
+			return routeKey(r) == routeKey(want)
+		})
+		if i < 0 {
+			if err = RouteAdd(want); err != nil {
+				return err
+			}
+			record("add-route", want.Dst.String())
+			continue
+		}
+
+		have := current[i]
+		if have.Index == want.Index &&
+			have.Gateway == want.Gateway &&
+			(!want.Src.IsValid() || have.Src == want.Src) &&
+			(want.MTU == 0 || have.MTU == want.MTU) {
+			continue
+		}
+		if err = RouteReplace(want); err != nil {
+			return err
+		}
+		record("replace-route", want.Dst.String())
+	}
+
+	if !spec.Purge {
+		return nil
+	}
+
+	for _, r := range current {
+		if r.Index != index || r.Protocol == unix.RTPROT_KERNEL || r.Table == unix.RT_TABLE_LOCAL {
+			continue
+		}
+		keep := slices.ContainsFunc(wanted, func(want Route) bool {
+			return routeKey(r) == routeKey(want)
+		})
+		if keep {
+			continue
+		}
+		if err = RouteDel(r); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		record("del-route", r.Dst.String())
+	}
+
+	return nil
+}
+
+// routeKey identifies a route the same way the kernel does, routes with
+// the same key replace each other.
+func routeKey(r Route) string {
+	table := r.Table
+	if table == 0 {
+		table = unix.RT_TABLE_MAIN
+	}
+	typ := r.Type
+	if typ == 0 {
+		typ = unix.RTN_UNICAST
+	}
+	metric := r.Metric
+	// IPv6 routes without a metric get the default metric of ip route
+	if metric == 0 && r.Dst.Addr().Is6() {
+		metric = 1024
+	}
+	return fmt.Sprintf("%d %s %d %d", table, r.Dst.Masked(), metric, typ)
+}
+
+// applyRules runs inside the namespace of the interface.
+func (IF *Interface) applyRules(spec Spec, record func(string, string)) (err error) {
+	if len(spec.Rules) == 0 && !spec.Purge {
+		return nil
+	}
+
+	current, err := RuleList(syscall.AF_UNSPEC)
+	if err != nil {
+		return err
+	}
+
+	for _, want := range spec.Rules {
+		if slices.ContainsFunc(current, func(r Rule) bool { return ruleMatches(want, r) }) {
+			continue
+		}
+		if err = RuleAdd(want); err != nil {
+			return err
+		}
+		record("add-rule", fmt.Sprintf("priority %d table %d", want.Priority, want.Table))
+	}
+
+	if !spec.Purge {
+		return nil
+	}
+
+	tables := make(map[uint32]bool)
+	for _, r := range spec.Routes {
+		switch r.Table {
+		case 0, unix.RT_TABLE_MAIN, unix.RT_TABLE_LOCAL, unix.RT_TABLE_DEFAULT:
+		default:
+			tables[r.Table] = true
+		}
+	}
+
+	for _, r := range current {
+		if r.IIF != IF.Name && r.OIF != IF.Name && !tables[r.Table] {
+			continue
+		}
+		wanted := slices.ContainsFunc(spec.Rules, func(want Rule) bool {
+			return ruleMatches(want, r)
+		})
+		if wanted {
+			continue
+		}
+		if err = RuleDel(r); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		record("del-rule", fmt.Sprintf("priority %d table %d", r.Priority, r.Table))
+	}
+
+	return nil
+}
+
+// ruleMatches reports whether the kernel rule have is the rule want, with
+// the same defaults as RuleAdd. A want without priority matches any.
+func ruleMatches(want Rule, have Rule) bool {
+	family := syscall.AF_INET
+	switch {
+	case want.Family != 0:
+		family = want.Family
+	case want.Src.IsValid() && want.Src.Addr().Is6():
+		family = syscall.AF_INET6
+	case want.Dst.IsValid() && want.Dst.Addr().Is6():
+		family = syscall.AF_INET6
+	}
+
+	action := want.Action
+	if action == 0 {
+		action = unix.FR_ACT_TO_TBL
+	}
+	table := want.Table
+	if table == 0 && action == unix.FR_ACT_TO_TBL {
+		table = unix.RT_TABLE_MAIN
+	}
+	mask := want.Mask
+	if mask == 0 && want.Mark != 0 {
+		mask = 0xffffffff
+	}
+
+	return have.Family == family &&
+		have.Action == action &&
+		have.Table == table &&
+		(want.Priority == 0 || have.Priority == want.Priority) &&
+		have.Src == want.Src &&
+		have.Dst == want.Dst &&
+		have.Mark == want.Mark &&
+		have.Mask == mask &&
+		have.IIF == want.IIF &&
+		have.OIF == want.OIF &&
+		have.UIDStart == want.UIDStart &&
+		have.UIDEnd == want.UIDEnd &&
+		have.Invert == want.Invert &&
+		have.Suppress == want.Suppress &&
+		have.SuppressPrefixLength == want.SuppressPrefixLength
+}
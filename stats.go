@@ -0,0 +1,187 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// LinkStats are the kernel counters of a link, from rtnl_link_stats64.
+type LinkStats struct {
+	RxPackets         uint64
+	TxPackets         uint64
+	RxBytes           uint64
+	TxBytes           uint64
+	RxErrors          uint64
+	TxErrors          uint64
+	RxDropped         uint64
+	TxDropped         uint64
+	Multicast         uint64
+	Collisions        uint64
+	RxLengthErrors    uint64
+	RxOverErrors      uint64
+	RxCRCErrors       uint64
+	RxFrameErrors     uint64
+	RxFIFOErrors      uint64
+	RxMissedErrors    uint64
+	TxAbortedErrors   uint64
+	TxCarrierErrors   uint64
+	TxFIFOErrors      uint64
+	TxHeartbeatErrors uint64
+	TxWindowErrors    uint64
+	RxCompressed      uint64
+	TxCompressed      uint64
+	RxNoHandler       uint64
+}
+
+// UserStats are counted by the package on the read and write path of
+// the interface file descriptors.
+type UserStats struct {
+	ReadPackets  uint64
+	ReadBytes    uint64
+	ReadErrors   uint64
+	WritePackets uint64
+	WriteBytes   uint64
+	WriteErrors  uint64
+	// WouldBlock counts reads and writes that failed with EAGAIN or
+	// timed out on a deadline.
+	WouldBlock uint64
+	// ShortWrites counts writes where the kernel took less than the
+	// whole packet.
+	ShortWrites uint64
+	// Truncated counts reads that filled the whole buffer, the packet
+	// was most likely larger than the buffer.
+	Truncated uint64
+	// Oversized counts writes of packets larger than the MTU.
+	Oversized uint64
+}
+
+// Stats holds the kernel and userspace counters of an interface.
+type Stats struct {
+	Kernel    LinkStats
+	Userspace UserStats
+}
+
+// counters is the live version of UserStats.
+type counters struct {
+	readPackets  atomic.Uint64
+	readBytes    atomic.Uint64
+	readErrors   atomic.Uint64
+	writePackets atomic.Uint64
+	writeBytes   atomic.Uint64
+	writeErrors  atomic.Uint64
+	wouldBlock   atomic.Uint64
+	shortWrites  atomic.Uint64
+	truncated    atomic.Uint64
+	oversized    atomic.Uint64
+}
+
+func (c *counters) snapshot() UserStats {
+	return UserStats{
+		ReadPackets:  c.readPackets.Load(),
+		ReadBytes:    c.readBytes.Load(),
+		ReadErrors:   c.readErrors.Load(),
+		WritePackets: c.writePackets.Load(),
+		WriteBytes:   c.writeBytes.Load(),
+		WriteErrors:  c.writeErrors.Load(),
+		WouldBlock:   c.wouldBlock.Load(),
+		ShortWrites:  c.shortWrites.Load(),
+		Truncated:    c.truncated.Load(),
+		Oversized:    c.oversized.Load(),
+	}
+}
+
+func (c *counters) countRead(n int, size int, err error) {
+	if err != nil {
+		if errors.Is(err, syscall.EAGAIN) || errors.Is(err, os.ErrDeadlineExceeded) {
+			c.wouldBlock.Add(1)
+		} else if !errors.Is(err, os.ErrClosed) {
+			c.readErrors.Add(1)
+		}
+		return
+	}
+	c.readPackets.Add(1)
+	c.readBytes.Add(uint64(n))
+	if n == size {
+		c.truncated.Add(1)
+	}
+}
+
+func (c *counters) countWrite(n int, size int, mtu int, err error) {
+	if mtu > 0 && size > mtu {
+		c.oversized.Add(1)
+	}
+	if err != nil {
+		if errors.Is(err, syscall.EAGAIN) || errors.Is(err, os.ErrDeadlineExceeded) {
+			c.wouldBlock.Add(1)
+		} else if !errors.Is(err, os.ErrClosed) {
+			c.writeErrors.Add(1)
+		}
+		return
+	}
+	c.writePackets.Add(1)
+	c.writeBytes.Add(uint64(n))
+	if n < size {
+		c.shortWrites.Add(1)
+	}
+}
+
+// Stats returns the kernel counters of the interface together with the
+// counters kept by the package for IF.RWC and the queues.
+func (IF *Interface) Stats() (s Stats, err error) {
+	err = IF.do(func() (err error) {
+		s.Kernel, err = LinkStatistics(IF.Name)
+		return err
+	})
+	if err != nil {
+		return
+	}
+
+	s.Userspace = IF.counters.snapshot()
+	return
+}
+
+// LinkStatistics returns the kernel counters of any link by name.
+func LinkStatistics(name string) (s LinkStats, err error) {
+	var ifi unix.IfInfomsg
+	m := newNetlinkMessage(unix.RTM_GETLINK, 0, unsafe.Pointer(&ifi), unix.SizeofIfInfomsg)
+	m.addString(unix.IFLA_IFNAME, name)
+
+	replies, err := netlinkExecute("getlink", m)
+	if err != nil {
+		return s, err
+	}
+	if len(replies) == 0 || len(replies[0]) < unix.SizeofIfInfomsg {
+		return s, &NetlinkError{Op: "getlink", Errno: syscall.ENODEV}
+	}
+
+	return parseLinkStats(parseNetlinkAttrs(replies[0][unix.SizeofIfInfomsg:]).get(unix.IFLA_STATS64)), nil
+}
+
+func parseLinkStats(b []byte) (s LinkStats) {
+	fields := []*uint64{
+		&s.RxPackets, &s.TxPackets, &s.RxBytes, &s.TxBytes,
+		&s.RxErrors, &s.TxErrors, &s.RxDropped, &s.TxDropped,
+		&s.Multicast, &s.Collisions,
+		&s.RxLengthErrors, &s.RxOverErrors, &s.RxCRCErrors, &s.RxFrameErrors,
+		&s.RxFIFOErrors, &s.RxMissedErrors,
+		&s.TxAbortedErrors, &s.TxCarrierErrors, &s.TxFIFOErrors,
+		&s.TxHeartbeatErrors, &s.TxWindowErrors,
+		&s.RxCompressed, &s.TxCompressed, &s.RxNoHandler,
+	}
+
+	for i := range fields {
+		if len(b) < (i+1)*8 {
+			break
+		}
+		*fields[i] = binary.NativeEndian.Uint64(b[i*8:])
+	}
+	return
+}
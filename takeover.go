@@ -0,0 +1,273 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"sync"
+	"syscall"
+)
+
+var (
+	takeoverIPv4 = []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/1"),
+		netip.MustParsePrefix("128.0.0.0/1"),
+	}
+	takeoverIPv6 = []netip.Prefix{
+		netip.MustParsePrefix("::/1"),
+		netip.MustParsePrefix("8000::/1"),
+	}
+)
+
+// DefaultRouteTakeover sends all traffic into Interface by installing two
+// half default routes (0.0.0.0/1 and 128.0.0.0/1, ::/1 and 8000::/1)
+// which win over the default route without touching it. Endpoints, the
+// remote ends of the tunnel, get host routes through the current physical
+// gateway so the tunnel traffic itself does not loop.
+type DefaultRouteTakeover struct {
+	Interface string
+	Endpoints []netip.Addr
+	IPv4      bool
+	IPv6      bool
+	Metric    uint32
+	// AutoRefresh re-resolves the endpoint routes whenever the default
+	// route of the system changes, for example when switching networks.
+	AutoRefresh bool
+
+	mu        sync.Mutex
+	halves    []Route
+	endpoints []Route
+	events    *EventStream
+}
+
+// Up installs the endpoint routes and then the half default routes.
+// Anything installed before an error is removed again.
+func (T *DefaultRouteTakeover) Up() (err error) {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+
+	if !T.IPv4 && !T.IPv6 {
+		return errors.New("at least one of IPv4 and IPv6 must be enabled")
+	}
+
+	routes, err := T.resolveEndpoints()
+	if err == nil {
+		err = T.replaceEndpoints(routes)
+	}
+	if err != nil {
+		T.teardown()
+		return err
+	}
+
+	var prefixes []netip.Prefix
+	if T.IPv4 {
+		prefixes = append(prefixes, takeoverIPv4...)
+	}
+	if T.IPv6 {
+		prefixes = append(prefixes, takeoverIPv6...)
+	}
+
+	for _, prefix := range prefixes {
+		r := Route{
+			Dst:       prefix,
+			Interface: T.Interface,
+			Metric:    T.Metric,
+		}
+		if err = RouteReplace(r); err != nil {
+			T.teardown()
+			return err
+		}
+		T.halves = append(T.halves, r)
+	}
+
+	if T.AutoRefresh {
+		if T.events, err = Subscribe(); err != nil {
+			T.teardown()
+			return err
+		}
+		go T.watch(T.events)
+	}
+
+	return nil
+}
+
+// Down removes every route installed by Up.
+func (T *DefaultRouteTakeover) Down() (err error) {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+
+	return T.teardown()
+}
+
+// Refresh re-resolves the routes to the endpoints, it is called
+// automatically when AutoRefresh is set. The current routes stay in place
+// when the new uplink can not be resolved.
+func (T *DefaultRouteTakeover) Refresh() (err error) {
+	T.mu.Lock()
+	defer T.mu.Unlock()
+
+	if len(T.halves) == 0 {
+		return nil
+	}
+
+	routes, err := T.resolveEndpoints()
+	if err != nil {
+		return err
+	}
+	return T.replaceEndpoints(routes)
+}
+
+func (T *DefaultRouteTakeover) watch(events *EventStream) {
+	for e := range events.Events {
+		if e.Type == EventDefaultRouteChanged || e.Type == EventOverflow {
+			_ = T.Refresh()
+		}
+	}
+}
+
+func (T *DefaultRouteTakeover) teardown() (err error) {
+	if T.events != nil {
+		T.events.Close()
+		T.events = nil
+	}
+
+	var errs []error
+	for i := len(T.halves) - 1; i >= 0; i-- {
+		if rerr := RouteDel(T.halves[i]); rerr != nil && !errors.Is(rerr, ErrNotFound) {
+			errs = append(errs, rerr)
+		}
+	}
+	T.halves = nil
+
+	if rerr := T.removeEndpoints(); rerr != nil {
+		errs = append(errs, rerr)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (T *DefaultRouteTakeover) removeEndpoints() (err error) {
+	var errs []error
+	for i := len(T.endpoints) - 1; i >= 0; i-- {
+		if rerr := RouteDel(T.endpoints[i]); rerr != nil && !errors.Is(rerr, ErrNotFound) {
+			errs = append(errs, rerr)
+		}
+	}
+	T.endpoints = nil
+
+	return errors.Join(errs...)
+}
+
+// resolveEndpoints returns a host route through the physical uplink for
+// every endpoint, nothing is changed on the system.
+func (T *DefaultRouteTakeover) resolveEndpoints() (routes []Route, err error) {
+	for _, ep := range T.Endpoints {
+		ep = ep.Unmap()
+		if (ep.Is4() && !T.IPv4) || (ep.Is6() && !T.IPv6) {
+			continue
+		}
+
+		via, err := T.physicalRoute(ep)
+		if err != nil {
+			return nil, err
+		}
+
+		routes = append(routes, Route{
+			Dst:       netip.PrefixFrom(ep, ep.BitLen()),
+			Gateway:   via.Gateway,
+			Interface: via.Interface,
+			Index:     via.Index,
+			Metric:    T.Metric,
+		})
+	}
+
+	return routes, nil
+}
+
+// replaceEndpoints puts routes in place of the current endpoint routes.
+// A route to the same endpoint is replaced in place, routes to endpoints
+// that are gone are only deleted once every new route is installed.
+func (T *DefaultRouteTakeover) replaceEndpoints(routes []Route) (err error) {
+	for _, r := range routes {
+		if err = RouteReplace(r); err != nil {
+			return err
+		}
+		if i := T.endpointIndex(r); i >= 0 {
+			T.endpoints[i] = r
+		} else {
+			T.endpoints = append(T.endpoints, r)
+		}
+	}
+
+	var errs []error
+	kept := T.endpoints[:0]
+	for _, r := range T.endpoints {
+		if slices.ContainsFunc(routes, func(n Route) bool { return routeKey(n) == routeKey(r) }) {
+			kept = append(kept, r)
+			continue
+		}
+		if rerr := RouteDel(r); rerr != nil && !errors.Is(rerr, ErrNotFound) {
+			errs = append(errs, rerr)
+			kept = append(kept, r)
+		}
+	}
+	T.endpoints = kept
+
+	return errors.Join(errs...)
+}
+
+// endpointIndex returns the index of the installed endpoint route that r
+// would replace, -1 if there is none.
+func (T *DefaultRouteTakeover) endpointIndex(r Route) int {
+	return slices.IndexFunc(T.endpoints, func(e Route) bool { return routeKey(e) == routeKey(r) })
+}
+
+// physicalRoute finds the route to ep that does not use the tunnel. Once
+// the half default routes are installed the kernel would send ep into the
+// tunnel, and once an endpoint route is installed the kernel would use it.
+// In both cases the most specific route of the main table that is not one
+// of ours is used.
+func (T *DefaultRouteTakeover) physicalRoute(ep netip.Addr) (r Route, err error) {
+	host := Route{Dst: netip.PrefixFrom(ep, ep.BitLen()), Metric: T.Metric}
+	if T.endpointIndex(host) < 0 {
+		r, err = RouteGet(ep)
+		if err != nil {
+			return r, err
+		}
+		if r.Interface != T.Interface {
+			return r, nil
+		}
+	}
+
+	family := syscall.AF_INET
+	if ep.Is6() {
+		family = syscall.AF_INET6
+	}
+
+	routes, err := RouteList(family, TableMain)
+	if err != nil {
+		return r, err
+	}
+
+	found := false
+	for _, candidate := range routes {
+		if !candidate.Dst.Contains(ep) || candidate.Interface == T.Interface || candidate.Type != RouteTypeUnicast {
+			continue
+		}
+		if T.endpointIndex(candidate) >= 0 {
+			continue
+		}
+		better := candidate.Dst.Bits() > r.Dst.Bits() ||
+			(candidate.Dst.Bits() == r.Dst.Bits() && candidate.Metric < r.Metric)
+		if !found || better {
+			r, found = candidate, true
+		}
+	}
+	if !found {
+		return r, errors.New("no physical route to " + ep.String())
+	}
+
+	return r, nil
+}
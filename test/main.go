@@ -60,24 +60,16 @@ func rawSock() {
 		return
 	}
 
-	outbuf := make([]byte, 1)
 	for {
-		n, err := socket.RWC.Read(outbuf[0:])
-		if n < 0 {
-			tid := C.getThreadID()
-			fmt.Println("RID:", tid)
-			time.Sleep(100 * time.Microsecond)
-			// runtime.Gosched()
-			continue
-		}
+		n, err := socket.RWC.Read(buffer)
 		if err != nil {
 			fmt.Println(err)
 		} else {
 			tid := C.getThreadID()
 			fmt.Println("RID:", tid)
-			x := gopacket.NewPacket(socket.SocketBuffer[:n], layers.LayerTypeIPv4, gopacket.Default)
+			x := gopacket.NewPacket(buffer[:n], layers.LayerTypeIPv4, gopacket.Default)
 			fmt.Println(x)
-			fmt.Println(socket.SocketBuffer[:n])
+			fmt.Println(buffer[:n])
 		}
 		// fmt.Println(n)
 		// time.Sleep(1 * time.Second)
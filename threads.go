@@ -0,0 +1,250 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// IOThread is a packet loop running on its own locked OS thread pinned
+// to a single CPU. Packets read and written through it are counted in
+// its ThreadStats.
+type IOThread struct {
+	// Index is the queue the thread serves, zero on a RawSocket.
+	Index int
+	// CPU is the CPU the thread is pinned to.
+	CPU int
+
+	tid      atomic.Int64
+	batches  atomic.Uint64
+	counters counters
+
+	read  func(bufs [][]byte, sizes []int) (int, error)
+	write func(bufs [][]byte) (int, error)
+}
+
+// ThreadStats are the counters of a single IOThread.
+type ThreadStats struct {
+	Index int
+	CPU   int
+	// TID is the kernel thread ID, zero until the thread has started.
+	TID int
+	// ReadBatches counts the ReadBatch calls that returned packets.
+	ReadBatches uint64
+	Userspace   UserStats
+}
+
+// TID returns the kernel thread ID of the thread.
+func (W *IOThread) TID() int {
+	return int(W.tid.Load())
+}
+
+// ReadBatch reads a batch of packets from the queue of the thread, see
+// Interface.ReadBatch and RawSocket.ReadBatch.
+func (W *IOThread) ReadBatch(bufs [][]byte, sizes []int) (n int, err error) {
+	n, err = W.read(bufs, sizes)
+	if n > 0 {
+		W.batches.Add(1)
+	}
+	for i := 0; i < n; i++ {
+		W.counters.countRead(sizes[i], len(bufs[i]), nil)
+	}
+	if err != nil {
+		W.counters.countRead(0, 0, err)
+	}
+	return n, err
+}
+
+// WriteBatch writes a batch of packets to the queue of the thread, see
+// Interface.WriteBatch and RawSocket.WriteBatch.
+func (W *IOThread) WriteBatch(bufs [][]byte) (n int, err error) {
+	n, err = W.write(bufs)
+	for i := 0; i < n; i++ {
+		W.counters.countWrite(len(bufs[i]), len(bufs[i]), 0, nil)
+	}
+	if err != nil {
+		W.counters.countWrite(0, 0, 0, err)
+	}
+	return n, err
+}
+
+// Stats returns the counters of the thread.
+func (W *IOThread) Stats() ThreadStats {
+	return ThreadStats{
+		Index:       W.Index,
+		CPU:         W.CPU,
+		TID:         W.TID(),
+		ReadBatches: W.batches.Load(),
+		Userspace:   W.counters.snapshot(),
+	}
+}
+
+// ioThreads keeps the threads of the last RunIOThreads call.
+type ioThreads struct {
+	mu      sync.Mutex
+	running bool
+	list    []*IOThread
+}
+
+func (t *ioThreads) stats() (s []ThreadStats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, W := range t.list {
+		s = append(s, W.Stats())
+	}
+	return
+}
+
+// run pins every thread to a CPU and runs fn on each of them, it returns
+// once every fn has returned. The CPUs are checked against the affinity
+// of the process before any thread starts.
+func (t *ioThreads) run(cpus []int, threads []*IOThread, fn func(W *IOThread) error) (err error) {
+	allowed, err := allowedCPUs()
+	if err != nil {
+		return err
+	}
+	if len(cpus) == 0 {
+		cpus = allowed
+	}
+	for _, W := range threads {
+		W.CPU = cpus[W.Index%len(cpus)]
+		if !slices.Contains(allowed, W.CPU) {
+			return fmt.Errorf("pin thread %d to cpu %d: cpu is not available to the process", W.Index, W.CPU)
+		}
+	}
+
+	t.mu.Lock()
+	if t.running {
+		t.mu.Unlock()
+		return errors.New("I/O threads are already running")
+	}
+	t.running = true
+	t.list = threads
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		t.running = false
+		t.mu.Unlock()
+	}()
+
+	// no fn starts before every thread is pinned, when one of them fails
+	// none of them runs
+	errs := make([]error, len(threads))
+	var wg, pinned sync.WaitGroup
+	start := make(chan struct{})
+	failed := false
+	for i, W := range threads {
+		wg.Add(1)
+		pinned.Add(1)
+		go func(i int, W *IOThread) {
+			defer wg.Done()
+
+			// the thread is never unlocked, so it exits with the goroutine
+			// instead of going back to the scheduler with its affinity
+			runtime.LockOSThread()
+			W.tid.Store(int64(unix.Gettid()))
+
+			var set unix.CPUSet
+			set.Set(W.CPU)
+			if err := unix.SchedSetaffinity(0, &set); err != nil {
+				errs[i] = fmt.Errorf("pin thread %d to cpu %d: %w", W.Index, W.CPU, err)
+			}
+			pinned.Done()
+
+			<-start
+			if failed {
+				return
+			}
+			errs[i] = fn(W)
+		}(i, W)
+	}
+	pinned.Wait()
+	failed = errors.Join(errs...) != nil
+	close(start)
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// allowedCPUs returns the CPUs the process may run on in order.
+func allowedCPUs() (cpus []int, err error) {
+	var set unix.CPUSet
+	if err = unix.SchedGetaffinity(0, &set); err != nil {
+		return nil, err
+	}
+	for cpu := 0; cpu < len(set)*64; cpu++ {
+		if set.IsSet(cpu) {
+			cpus = append(cpus, cpu)
+		}
+	}
+	if len(cpus) == 0 {
+		return nil, errors.New("no CPUs available")
+	}
+	return cpus, nil
+}
+
+// RunIOThreads runs fn once per queue, each on a locked OS thread pinned
+// to the CPU matching its queue, see IF.CPUs. An interface without
+// queues runs a single thread for IF.RWC. It returns once every fn has
+// returned, usually after Syscall_StopReader closed the queues.
+//
+// Threads of a multiqueue interface read and write their queue directly,
+// with VnetHdr set the packets keep their virtio_net_hdr.
+func (IF *Interface) RunIOThreads(fn func(W *IOThread) error) (err error) {
+	var threads []*IOThread
+	if len(IF.Queues) == 0 {
+		if IF.RWC == nil {
+			return errors.New("interface is not open")
+		}
+		threads = append(threads, &IOThread{
+			read:  IF.ReadBatch,
+			write: IF.WriteBatch,
+		})
+	}
+
+	for _, q := range IF.Queues {
+		T, ok := q.RWC.(*TunFile)
+		if !ok {
+			return errors.New("queue is not open")
+		}
+		threads = append(threads, &IOThread{
+			Index: q.Index,
+			read:  T.ReadBatch,
+			write: T.WriteBatch,
+		})
+	}
+
+	return IF.threads.run(IF.CPUs, threads, fn)
+}
+
+// ThreadStats returns the counters of every thread started by the last
+// RunIOThreads call.
+func (IF *Interface) ThreadStats() []ThreadStats {
+	return IF.threads.stats()
+}
+
+// RunIOThreads runs fn on a locked OS thread pinned to r.CPUs[0] and
+// returns what it returns, usually after Close.
+func (r *RawSocket) RunIOThreads(fn func(W *IOThread) error) (err error) {
+	if r.RWC == nil {
+		return errors.New("socket is not open")
+	}
+	return r.threads.run(r.CPUs, []*IOThread{{
+		read:  r.ReadBatch,
+		write: r.WriteBatch,
+	}}, fn)
+}
+
+// ThreadStats returns the counters of the thread started by the last
+// RunIOThreads call.
+func (r *RawSocket) ThreadStats() []ThreadStats {
+	return r.threads.stats()
+}
@@ -0,0 +1,414 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// io_uring constants from linux/io_uring.h
+const (
+	uringOffSQRing = 0
+	uringOffCQRing = 0x8000000
+	uringOffSQEs   = 0x10000000
+
+	uringOpNop       = 0
+	uringOpReadFixed = 4
+	uringOpPollAdd   = 6
+
+	uringSQELink = 1 << 2
+
+	uringEnterGetEvents = 1 << 0
+	uringRegisterBufs   = 0
+	uringFeatSingleMmap = 1 << 0
+
+	// uringClose is the user data of the NOP that wakes the reader on Close.
+	uringClose = ^uint64(0)
+	// uringPoll marks the user data of the poll in front of every read.
+	uringPoll = 1 << 62
+
+	defaultUringEntries = 64
+)
+
+// ErrUringUnavailable is returned by NewUring when the kernel does not
+// support io_uring or it is disabled.
+var ErrUringUnavailable = errors.New("io_uring is not available")
+
+// uringParams is the struct io_uring_params
+type uringParams struct {
+	SQEntries    uint32
+	CQEntries    uint32
+	Flags        uint32
+	SQThreadCPU  uint32
+	SQThreadIdle uint32
+	Features     uint32
+	WQFd         uint32
+	Resv         [3]uint32
+	SQOff        struct {
+		Head, Tail, RingMask, RingEntries, Flags, Dropped, Array, Resv1 uint32
+		UserAddr                                                        uint64
+	}
+	CQOff struct {
+		Head, Tail, RingMask, RingEntries, Overflow, CQEs, Flags, Resv1 uint32
+		UserAddr                                                        uint64
+	}
+}
+
+// uringSQE is the struct io_uring_sqe
+type uringSQE struct {
+	Opcode      uint8
+	Flags       uint8
+	IOPrio      uint16
+	Fd          int32
+	Off         uint64
+	Addr        uint64
+	Len         uint32
+	RWFlags     uint32
+	UserData    uint64
+	BufIndex    uint16
+	Personality uint16
+	SpliceFdIn  int32
+	Addr3       uint64
+	pad         uint64
+}
+
+// uringCQE is the struct io_uring_cqe
+type uringCQE struct {
+	UserData uint64
+	Res      int32
+	Flags    uint32
+}
+
+// Uring keeps a number of reads posted on a file descriptor through
+// io_uring. Every read has its own registered buffer, ReadBatch harvests
+// every completed read with one system call and posts the reads again.
+// The file descriptors of the package are non-blocking, so every read is
+// linked behind a poll that waits for the descriptor to become readable,
+// otherwise the kernel completes the reads with EAGAIN straight away.
+//
+// Waiting for completions blocks the calling thread, not just the
+// goroutine, so a Uring is best used from a dedicated reader goroutine.
+type Uring struct {
+	fd     int
+	target int
+
+	sqRing, cqRing, sqes []byte
+
+	sqHead, sqTail, sqMask, sqArray *uint32
+	cqHead, cqTail, cqMask          *uint32
+	cqes                            uint32
+	sqEntries                       uint32
+
+	bufSize int
+	bufs    []byte
+	repost  []int
+
+	// submit guards the submission queue, read is held by ReadBatch and
+	// lets Close wait for the reader to leave.
+	submit sync.Mutex
+	read   sync.Mutex
+	closed atomic.Bool
+}
+
+// NewUring sets up io_uring for fd with entries reads of up to bufSize
+// bytes posted at all times. ErrUringUnavailable is returned when the
+// kernel can not provide io_uring, callers should fall back to normal
+// reads in that case.
+func NewUring(fd int, entries int, bufSize int) (U *Uring, err error) {
+	if entries <= 0 {
+		entries = defaultUringEntries
+	}
+
+	// a poll and a read per entry and one extra entry for the NOP sent by
+	// Close
+	var params uringParams
+	r0, _, e1 := syscall.Syscall(
+		unix.SYS_IO_URING_SETUP,
+		uintptr(2*entries+1),
+		uintptr(unsafe.Pointer(&params)),
+		0,
+	)
+	if e1 != 0 {
+		if e1 == syscall.ENOSYS || e1 == syscall.EPERM || e1 == syscall.EACCES {
+			return nil, ErrUringUnavailable
+		}
+		return nil, os.NewSyscallError("io_uring_setup", e1)
+	}
+
+	U = &Uring{
+		fd:        int(r0),
+		target:    fd,
+		bufSize:   bufSize,
+		sqEntries: params.SQEntries,
+	}
+	if err = U.mmap(&params); err != nil {
+		U.unmap()
+		return nil, err
+	}
+
+	if err = U.register(entries); err != nil {
+		U.unmap()
+		return nil, err
+	}
+
+	for i := 0; i < entries; i++ {
+		U.postRead(i)
+	}
+	if err = U.enter(uint32(2*entries), 0, 0); err != nil {
+		U.unmap()
+		return nil, err
+	}
+
+	return U, nil
+}
+
+func (U *Uring) mmap(p *uringParams) (err error) {
+	sqSize := int(p.SQOff.Array + p.SQEntries*4)
+	cqSize := int(p.CQOff.CQEs + p.CQEntries*uint32(unsafe.Sizeof(uringCQE{})))
+	single := p.Features&uringFeatSingleMmap != 0
+	if single && cqSize > sqSize {
+		sqSize = cqSize
+	}
+
+	prot := syscall.PROT_READ | syscall.PROT_WRITE
+	flags := syscall.MAP_SHARED | syscall.MAP_POPULATE
+
+	if U.sqRing, err = syscall.Mmap(U.fd, uringOffSQRing, sqSize, prot, flags); err != nil {
+		return err
+	}
+	U.cqRing = U.sqRing
+	if !single {
+		if U.cqRing, err = syscall.Mmap(U.fd, uringOffCQRing, cqSize, prot, flags); err != nil {
+			return err
+		}
+	}
+	sqeSize := int(p.SQEntries) * int(unsafe.Sizeof(uringSQE{}))
+	if U.sqes, err = syscall.Mmap(U.fd, uringOffSQEs, sqeSize, prot, flags); err != nil {
+		return err
+	}
+
+	at := func(ring []byte, off uint32) *uint32 {
+		return (*uint32)(unsafe.Pointer(&ring[off]))
+	}
+	U.sqHead = at(U.sqRing, p.SQOff.Head)
+	U.sqTail = at(U.sqRing, p.SQOff.Tail)
+	U.sqMask = at(U.sqRing, p.SQOff.RingMask)
+	U.sqArray = at(U.sqRing, p.SQOff.Array)
+	U.cqHead = at(U.cqRing, p.CQOff.Head)
+	U.cqTail = at(U.cqRing, p.CQOff.Tail)
+	U.cqMask = at(U.cqRing, p.CQOff.RingMask)
+	U.cqes = p.CQOff.CQEs
+
+	return nil
+}
+
+// register registers one buffer per posted read with the kernel, the
+// pages stay pinned until the ring is closed. The buffers are mapped
+// outside of the Go heap, closing the ring cancels the posted reads in
+// the background and the kernel may still write to them after Close
+// returns.
+func (U *Uring) register(entries int) (err error) {
+	U.bufs, err = syscall.Mmap(
+		-1,
+		0,
+		entries*U.bufSize,
+		syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS,
+	)
+	if err != nil {
+		return err
+	}
+	U.repost = make([]int, 0, entries)
+	iovs := make([]unix.Iovec, entries)
+	for i := range iovs {
+		iovs[i].Base = &U.bufs[i*U.bufSize]
+		iovs[i].SetLen(U.bufSize)
+	}
+
+	_, _, e1 := syscall.Syscall6(
+		unix.SYS_IO_URING_REGISTER,
+		uintptr(U.fd),
+		uringRegisterBufs,
+		uintptr(unsafe.Pointer(&iovs[0])),
+		uintptr(len(iovs)),
+		0,
+		0,
+	)
+	if e1 != 0 {
+		// usually RLIMIT_MEMLOCK is too low to pin the buffers
+		if e1 == syscall.ENOMEM || e1 == syscall.EPERM {
+			return ErrUringUnavailable
+		}
+		return os.NewSyscallError("io_uring_register", e1)
+	}
+	return nil
+}
+
+func (U *Uring) unmap() {
+	if U.sqes != nil {
+		syscall.Munmap(U.sqes)
+	}
+	if U.cqRing != nil && &U.cqRing[0] != &U.sqRing[0] {
+		syscall.Munmap(U.cqRing)
+	}
+	if U.sqRing != nil {
+		syscall.Munmap(U.sqRing)
+	}
+	syscall.Close(U.fd)
+	// the kernel holds its own reference to the registered pages until
+	// the cancelled reads are gone
+	if U.bufs != nil {
+		syscall.Munmap(U.bufs)
+	}
+}
+
+// push adds an entry to the submission queue, the caller holds U.submit.
+func (U *Uring) push(sqe uringSQE) {
+	tail := atomic.LoadUint32(U.sqTail)
+	index := tail & *U.sqMask
+	*(*uringSQE)(unsafe.Pointer(&U.sqes[uintptr(index)*unsafe.Sizeof(sqe)])) = sqe
+	*(*uint32)(unsafe.Add(unsafe.Pointer(U.sqArray), uintptr(index)*4)) = index
+	atomic.StoreUint32(U.sqTail, tail+1)
+}
+
+// postRead pushes a poll for the target and the read linked behind it,
+// the read starts once the poll completes.
+func (U *Uring) postRead(i int) {
+	U.push(uringSQE{
+		Opcode:   uringOpPollAdd,
+		Flags:    uringSQELink,
+		Fd:       int32(U.target),
+		RWFlags:  unix.POLLIN,
+		UserData: uringPoll | uint64(i),
+	})
+	U.push(uringSQE{
+		Opcode:   uringOpReadFixed,
+		Fd:       int32(U.target),
+		Addr:     uint64(uintptr(unsafe.Pointer(&U.bufs[i*U.bufSize]))),
+		Len:      uint32(U.bufSize),
+		UserData: uint64(i),
+		BufIndex: uint16(i),
+	})
+}
+
+func (U *Uring) enter(submit uint32, wait uint32, flags uint32) error {
+	for {
+		_, _, e1 := syscall.Syscall6(
+			unix.SYS_IO_URING_ENTER,
+			uintptr(U.fd),
+			uintptr(submit),
+			uintptr(wait),
+			uintptr(flags),
+			0,
+			0,
+		)
+		if e1 == syscall.EINTR {
+			continue
+		}
+		if e1 != 0 {
+			return os.NewSyscallError("io_uring_enter", e1)
+		}
+		return nil
+	}
+}
+
+// ReadBatch waits until at least one posted read has completed and
+// copies every completed read into bufs, the length of each packet is
+// stored in sizes. The reads are posted again before it returns.
+func (U *Uring) ReadBatch(bufs [][]byte, sizes []int) (n int, err error) {
+	if len(sizes) < len(bufs) {
+		return 0, errors.New("sizes is shorter than bufs")
+	}
+
+	U.read.Lock()
+	defer U.read.Unlock()
+
+	for n == 0 {
+		if U.closed.Load() {
+			return 0, os.ErrClosed
+		}
+
+		head := atomic.LoadUint32(U.cqHead)
+		if head == atomic.LoadUint32(U.cqTail) {
+			if err = U.enter(0, 1, uringEnterGetEvents); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		repost := U.repost[:0]
+		for head != atomic.LoadUint32(U.cqTail) && n < len(bufs) {
+			cqe := (*uringCQE)(unsafe.Pointer(&U.cqRing[U.cqes+(head&*U.cqMask)*uint32(unsafe.Sizeof(uringCQE{}))]))
+			head++
+			// a failed poll cancels its read, which is reposted below
+			if cqe.UserData == uringClose || cqe.UserData&uringPoll != 0 {
+				continue
+			}
+
+			i := int(cqe.UserData)
+			repost = append(repost, i)
+
+			if cqe.Res < 0 {
+				errno := syscall.Errno(-cqe.Res)
+				if errno == syscall.EAGAIN || errno == syscall.EINTR || errno == syscall.ECANCELED {
+					continue
+				}
+				err = os.NewSyscallError("read", errno)
+				break
+			}
+
+			size := int(cqe.Res)
+			if size > len(bufs[n]) {
+				size = len(bufs[n])
+			}
+			sizes[n] = copy(bufs[n], U.bufs[i*U.bufSize:i*U.bufSize+size])
+			n++
+		}
+		atomic.StoreUint32(U.cqHead, head)
+
+		if len(repost) > 0 && !U.closed.Load() {
+			U.submit.Lock()
+			for _, i := range repost {
+				U.postRead(i)
+			}
+			serr := U.enter(uint32(2*len(repost)), 0, 0)
+			U.submit.Unlock()
+			if err == nil {
+				err = serr
+			}
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// Close wakes up ReadBatch, waits for it to return and releases the ring.
+// The target file descriptor is not closed.
+func (U *Uring) Close() error {
+	if U.closed.Swap(true) {
+		return nil
+	}
+
+	U.submit.Lock()
+	U.push(uringSQE{Opcode: uringOpNop, UserData: uringClose})
+	err := U.enter(1, 0, 0)
+	U.submit.Unlock()
+
+	U.read.Lock()
+	defer U.read.Unlock()
+
+	// closing the ring cancels the reads that are still posted, they only
+	// write to the pinned buffers
+	U.unmap()
+	return err
+}
@@ -0,0 +1,87 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func cpuTime(t *testing.T) time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		t.Fatal(err)
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+func TestUringIdleDoesNotSpin(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+
+	U, err := NewUring(fds[0], 4, 2048)
+	if errors.Is(err, ErrUringUnavailable) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		n    int
+		size int
+		err  error
+	}
+	done := make(chan result, 1)
+	bufs := [][]byte{make([]byte, 2048), make([]byte, 2048)}
+	sizes := make([]int, 2)
+	go func() {
+		n, err := U.ReadBatch(bufs, sizes)
+		done <- result{n, sizes[0], err}
+	}()
+
+	// the reader waits in the kernel while nothing arrives
+	start := cpuTime(t)
+	time.Sleep(300 * time.Millisecond)
+	if used := cpuTime(t) - start; used > 100*time.Millisecond {
+		t.Fatalf("idle ring used %v of CPU in 300ms", used)
+	}
+
+	if _, err := unix.Write(fds[1], []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-done:
+		if r.err != nil || r.n != 1 || r.size != 5 || string(bufs[0][:5]) != "hello" {
+			t.Fatalf("ReadBatch = %d, %d, %v", r.n, r.size, r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadBatch did not return the packet")
+	}
+
+	go func() {
+		_, err := U.ReadBatch(bufs, sizes)
+		done <- result{err: err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := U.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-done:
+		if !errors.Is(r.err, os.ErrClosed) {
+			t.Fatalf("ReadBatch after Close = %v", r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not unblock ReadBatch")
+	}
+}
@@ -0,0 +1,507 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// VnetHdrLen is the size of the virtio_net_hdr that prefixes every
+	// packet when Interface.VnetHdr is set.
+	VnetHdrLen = 10
+
+	// VnetMaxPacket is the largest super-packet the kernel will hand us,
+	// virtio header included.
+	VnetMaxPacket = VnetHdrLen + 0xffff
+
+	// maxCoalesce caps the number of segments merged into one super-packet.
+	maxCoalesce = 64
+)
+
+const (
+	VnetFlagNeedsCsum = unix.VIRTIO_NET_HDR_F_NEEDS_CSUM
+	VnetFlagDataValid = unix.VIRTIO_NET_HDR_F_DATA_VALID
+
+	VnetGSONone  = unix.VIRTIO_NET_HDR_GSO_NONE
+	VnetGSOTCPv4 = unix.VIRTIO_NET_HDR_GSO_TCPV4
+	VnetGSOUDP   = unix.VIRTIO_NET_HDR_GSO_UDP
+	VnetGSOTCPv6 = unix.VIRTIO_NET_HDR_GSO_TCPV6
+	VnetGSOUDPL4 = unix.VIRTIO_NET_HDR_GSO_UDP_L4
+	VnetGSOECN   = unix.VIRTIO_NET_HDR_GSO_ECN
+)
+
+// Offload flags for Interface.Offload, passed to TUNSETOFFLOAD.
+const (
+	OffloadCSUM = unix.TUN_F_CSUM
+	OffloadTSO4 = unix.TUN_F_TSO4
+	OffloadTSO6 = unix.TUN_F_TSO6
+	OffloadECN  = unix.TUN_F_TSO_ECN
+	OffloadUSO4 = unix.TUN_F_USO4
+	OffloadUSO6 = unix.TUN_F_USO6
+)
+
+var ErrShortVnetPacket = errors.New("packet is shorter than the virtio header")
+
+// VirtioNetHdr is the virtio_net_hdr from linux/virtio_net.h
+type VirtioNetHdr struct {
+	Flags      uint8
+	GSOType    uint8
+	HdrLen     uint16
+	GSOSize    uint16
+	CsumStart  uint16
+	CsumOffset uint16
+}
+
+func (h *VirtioNetHdr) Decode(b []byte) error {
+	if len(b) < VnetHdrLen {
+		return ErrShortVnetPacket
+	}
+	h.Flags = b[0]
+	h.GSOType = b[1]
+	h.HdrLen = binary.LittleEndian.Uint16(b[2:])
+	h.GSOSize = binary.LittleEndian.Uint16(b[4:])
+	h.CsumStart = binary.LittleEndian.Uint16(b[6:])
+	h.CsumOffset = binary.LittleEndian.Uint16(b[8:])
+	return nil
+}
+
+func (h *VirtioNetHdr) Encode(b []byte) error {
+	if len(b) < VnetHdrLen {
+		return ErrShortVnetPacket
+	}
+	b[0] = h.Flags
+	b[1] = h.GSOType
+	binary.LittleEndian.PutUint16(b[2:], h.HdrLen)
+	binary.LittleEndian.PutUint16(b[4:], h.GSOSize)
+	binary.LittleEndian.PutUint16(b[6:], h.CsumStart)
+	binary.LittleEndian.PutUint16(b[8:], h.CsumOffset)
+	return nil
+}
+
+// Syscall_Offload enables the virtio header and the offloads in IF.Offload.
+// It is called by Create when IF.VnetHdr is set.
+func (IF *Interface) Syscall_Offload() (err error) {
+	hdrLen := int32(VnetHdrLen)
+	if err = tunnelCtl(
+		IF.FD,
+		unix.TUNSETVNETHDRSZ,
+		uintptr(unsafe.Pointer(&hdrLen)),
+	); err != nil {
+		return err
+	}
+
+	if IF.Offload == 0 {
+		IF.Offload = OffloadCSUM | OffloadTSO4 | OffloadTSO6
+	}
+
+	return tunnelCtl(IF.FD, unix.TUNSETOFFLOAD, uintptr(IF.Offload))
+}
+
+// ReadVnet reads a single packet and its virtio header from the interface.
+// When GSO is enabled the packet can be much larger than the MTU,
+// use GSOSplit to turn it into MTU sized packets.
+func (IF *Interface) ReadVnet(buf []byte) (hdr VirtioNetHdr, n int, err error) {
+	n, err = IF.RWC.Read(buf)
+	if err != nil {
+		return
+	}
+	if err = hdr.Decode(buf[:n]); err != nil {
+		return
+	}
+	return
+}
+
+// ReadPackets reads one super-packet from the interface and splits it
+// into bufs. It returns the number of packets written to bufs, the
+// length of each one is stored in sizes.
+func (IF *Interface) ReadPackets(bufs [][]byte, sizes []int) (n int, err error) {
+	if !IF.VnetHdr {
+		return 0, errors.New("interface does not have a virtio header")
+	}
+	if IF.vnetReadBuf == nil {
+		IF.vnetReadBuf = make([]byte, VnetMaxPacket)
+	}
+
+	hdr, size, err := IF.ReadVnet(IF.vnetReadBuf)
+	if err != nil {
+		return 0, err
+	}
+
+	return GSOSplit(IF.vnetReadBuf[VnetHdrLen:size], hdr, bufs, sizes)
+}
+
+// WritePackets coalesces TCP and UDP packets that belong to the same flow
+// and writes them to the interface as super-packets. It returns the
+// number of packets from bufs that were written.
+func (IF *Interface) WritePackets(bufs [][]byte) (n int, err error) {
+	if !IF.VnetHdr {
+		return 0, errors.New("interface does not have a virtio header")
+	}
+	if IF.vnetWriteBuf == nil {
+		IF.vnetWriteBuf = make([]byte, VnetMaxPacket)
+	}
+
+	uso := IF.Offload&(OffloadUSO4|OffloadUSO6) == OffloadUSO4|OffloadUSO6
+
+	for n < len(bufs) {
+		hdr, size, count := GROCoalesce(IF.vnetWriteBuf[VnetHdrLen:], bufs[n:], uso)
+		if count == 0 {
+			return n, fmt.Errorf("packet %d is too large for the write buffer", n)
+		}
+		_ = hdr.Encode(IF.vnetWriteBuf)
+
+		if _, err = IF.RWC.Write(IF.vnetWriteBuf[:VnetHdrLen+size]); err != nil {
+			return n, err
+		}
+		n += count
+	}
+
+	return
+}
+
+// GSOSplit segments pkt according to hdr into bufs. Packets without GSO
+// are copied as they are, with the checksum completed if the kernel left
+// it partial.
+func GSOSplit(pkt []byte, hdr VirtioNetHdr, bufs [][]byte, sizes []int) (n int, err error) {
+	if hdr.GSOType == VnetGSONone {
+		if len(bufs) == 0 || len(sizes) == 0 || len(bufs[0]) < len(pkt) {
+			return 0, syscall.ENOBUFS
+		}
+		if hdr.Flags&VnetFlagNeedsCsum != 0 {
+			if err = completeChecksum(pkt, hdr); err != nil {
+				return 0, err
+			}
+		}
+		sizes[0] = copy(bufs[0], pkt)
+		return 1, nil
+	}
+
+	if len(pkt) < 20 {
+		return 0, errors.New("gso packet is too short")
+	}
+	version := pkt[0] >> 4
+	if version != 4 && version != 6 {
+		return 0, fmt.Errorf("unsupported ip version: %d", version)
+	}
+	iphLen := int(hdr.CsumStart)
+
+	var isTCP bool
+	switch hdr.GSOType &^ VnetGSOECN {
+	case VnetGSOTCPv4, VnetGSOTCPv6:
+		isTCP = true
+	case VnetGSOUDPL4:
+	default:
+		return 0, fmt.Errorf("unsupported gso type: %d", hdr.GSOType)
+	}
+
+	if (version == 4 && iphLen < 20) || (version == 6 && iphLen < 40) || iphLen+8 > len(pkt) {
+		return 0, errors.New("invalid gso csum start")
+	}
+
+	hdrLen := iphLen + 8
+	csumAt := iphLen + 6
+	if isTCP {
+		if iphLen+20 > len(pkt) {
+			return 0, errors.New("gso packet is too short")
+		}
+		hdrLen = iphLen + int(pkt[iphLen+12]>>4)*4
+		csumAt = iphLen + 16
+		if hdrLen < iphLen+20 {
+			return 0, errors.New("invalid tcp header length")
+		}
+		if hdrLen > len(pkt) {
+			return 0, errors.New("gso packet is too short")
+		}
+	}
+
+	var src, dst []byte
+	proto := uint8(unix.IPPROTO_UDP)
+	if isTCP {
+		proto = unix.IPPROTO_TCP
+	}
+	if version == 4 {
+		src, dst = pkt[12:16], pkt[16:20]
+	} else {
+		src, dst = pkt[8:24], pkt[24:40]
+	}
+
+	gsoSize := int(hdr.GSOSize)
+	if gsoSize == 0 {
+		return 0, errors.New("gso size is zero")
+	}
+	firstID := binary.BigEndian.Uint16(pkt[4:])
+	firstSeq := uint32(0)
+	if isTCP {
+		firstSeq = binary.BigEndian.Uint32(pkt[iphLen+4:])
+	}
+
+	for off := hdrLen; off < len(pkt); off += gsoSize {
+		if n >= len(bufs) || n >= len(sizes) {
+			return n, syscall.ENOBUFS
+		}
+		end := off + gsoSize
+		if end > len(pkt) {
+			end = len(pkt)
+		}
+		segLen := hdrLen + end - off
+		out := bufs[n]
+		if len(out) < segLen {
+			return n, syscall.ENOBUFS
+		}
+
+		copy(out, pkt[:hdrLen])
+		copy(out[hdrLen:], pkt[off:end])
+
+		if version == 4 {
+			binary.BigEndian.PutUint16(out[2:], uint16(segLen))
+			binary.BigEndian.PutUint16(out[4:], firstID+uint16(n))
+			out[10], out[11] = 0, 0
+			binary.BigEndian.PutUint16(out[10:], Checksum(out[:iphLen], 0))
+		} else {
+			binary.BigEndian.PutUint16(out[4:], uint16(segLen-40))
+		}
+
+		if isTCP {
+			binary.BigEndian.PutUint32(out[iphLen+4:], firstSeq+uint32(off-hdrLen))
+			if end != len(pkt) {
+				// FIN and PSH only belong on the last segment
+				out[iphLen+13] &^= 0x01 | 0x08
+			}
+			if n > 0 {
+				// CWR only belongs on the first segment
+				out[iphLen+13] &^= 0x80
+			}
+		} else {
+			binary.BigEndian.PutUint16(out[iphLen+4:], uint16(segLen-iphLen))
+		}
+
+		out[csumAt], out[csumAt+1] = 0, 0
+		psum := pseudoHeaderSum(proto, src, dst, uint16(segLen-iphLen))
+		binary.BigEndian.PutUint16(out[csumAt:], Checksum(out[iphLen:segLen], psum))
+
+		sizes[n] = segLen
+		n++
+	}
+
+	return n, nil
+}
+
+// completeChecksum finishes a partial checksum as described by hdr.
+func completeChecksum(pkt []byte, hdr VirtioNetHdr) error {
+	start := int(hdr.CsumStart)
+	at := start + int(hdr.CsumOffset)
+	if at+2 > len(pkt) {
+		return errors.New("invalid checksum offset")
+	}
+	// The kernel leaves the folded pseudo header sum in the checksum
+	// field, so summing from csum_start gives the full checksum.
+	binary.BigEndian.PutUint16(pkt[at:], Checksum(pkt[start:], 0))
+	return nil
+}
+
+// flowInfo describes the parts of a TCP or UDP packet that matter when
+// deciding whether it can be coalesced.
+type flowInfo struct {
+	version byte
+	proto   byte
+	iphLen  int
+	hdrLen  int
+	seq     uint32
+	flags   byte
+}
+
+func parseFlow(pkt []byte) (f flowInfo, ok bool) {
+	if len(pkt) < 20 {
+		return f, false
+	}
+	f.version = pkt[0] >> 4
+
+	switch f.version {
+	case 4:
+		f.iphLen = int(pkt[0]&0x0f) * 4
+		if f.iphLen != 20 || int(binary.BigEndian.Uint16(pkt[2:])) != len(pkt) {
+			return f, false
+		}
+		// fragments can not be coalesced
+		if binary.BigEndian.Uint16(pkt[6:])&0x3fff != 0 {
+			return f, false
+		}
+		f.proto = pkt[9]
+	case 6:
+		f.iphLen = 40
+		if len(pkt) < 40 || int(binary.BigEndian.Uint16(pkt[4:]))+40 != len(pkt) {
+			return f, false
+		}
+		f.proto = pkt[6]
+	default:
+		return f, false
+	}
+
+	switch f.proto {
+	case unix.IPPROTO_TCP:
+		if len(pkt) < f.iphLen+20 {
+			return f, false
+		}
+		f.hdrLen = f.iphLen + int(pkt[f.iphLen+12]>>4)*4
+		f.seq = binary.BigEndian.Uint32(pkt[f.iphLen+4:])
+		f.flags = pkt[f.iphLen+13]
+	case unix.IPPROTO_UDP:
+		f.hdrLen = f.iphLen + 8
+	default:
+		return f, false
+	}
+
+	return f, f.hdrLen <= len(pkt)
+}
+
+// canFollow reports whether next can be appended to a super-packet that
+// starts with first and currently holds payload bytes of data.
+func canFollow(first, next []byte, ff, nf flowInfo, gsoSize, payload int) bool {
+	if ff.version != nf.version || ff.proto != nf.proto || ff.hdrLen != nf.hdrLen {
+		return false
+	}
+	nPayload := len(next) - nf.hdrLen
+	if nPayload == 0 || nPayload > gsoSize {
+		return false
+	}
+	if ff.hdrLen+payload+nPayload > 0xffff {
+		return false
+	}
+
+	if ff.version == 4 {
+		// tos, ttl, protocol and addresses
+		if first[1] != next[1] || first[8] != next[8] || !bytes.Equal(first[12:20], next[12:20]) {
+			return false
+		}
+		if first[6]&0x40 != next[6]&0x40 {
+			return false
+		}
+	} else {
+		if !bytes.Equal(first[:4], next[:4]) || first[7] != next[7] || !bytes.Equal(first[8:40], next[8:40]) {
+			return false
+		}
+	}
+
+	// ports
+	if !bytes.Equal(first[ff.iphLen:ff.iphLen+4], next[nf.iphLen:nf.iphLen+4]) {
+		return false
+	}
+
+	if ff.proto == unix.IPPROTO_TCP {
+		if nf.seq != ff.seq+uint32(payload) {
+			return false
+		}
+		// ack number, window and options
+		if !bytes.Equal(first[ff.iphLen+8:ff.iphLen+12], next[nf.iphLen+8:nf.iphLen+12]) ||
+			!bytes.Equal(first[ff.iphLen+14:ff.iphLen+16], next[nf.iphLen+14:nf.iphLen+16]) ||
+			!bytes.Equal(first[ff.iphLen+20:ff.hdrLen], next[nf.iphLen+20:nf.hdrLen]) {
+			return false
+		}
+		// only plain ACK segments, optionally with PSH on the last one
+		if nf.flags&^0x08 != 0x10 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// GROCoalesce merges as many packets from the start of pkts as possible
+// into out. It returns the virtio header to write in front of out, the
+// size of the super-packet and how many packets it contains. Packets that
+// can not be coalesced are returned on their own with an empty header.
+// UDP packets are only merged when uso is true.
+func GROCoalesce(out []byte, pkts [][]byte, uso bool) (hdr VirtioNetHdr, size int, count int) {
+	if len(pkts) == 0 || len(pkts[0]) > len(out) {
+		return
+	}
+
+	first := pkts[0]
+	size = copy(out, first)
+	count = 1
+
+	ff, ok := parseFlow(first)
+	if !ok || (ff.proto == unix.IPPROTO_UDP && !uso) {
+		return
+	}
+	if ff.proto == unix.IPPROTO_TCP && ff.flags&^0x08 != 0x10 {
+		return
+	}
+
+	gsoSize := len(first) - ff.hdrLen
+	payload := gsoSize
+	// PSH ends the super-packet, a UDP header has no flags
+	if gsoSize == 0 || (ff.proto == unix.IPPROTO_TCP && ff.flags&0x08 != 0) {
+		return
+	}
+
+	for count < len(pkts) && count < maxCoalesce {
+		next := pkts[count]
+		nf, ok := parseFlow(next)
+		if !ok || !canFollow(first, next, ff, nf, gsoSize, payload) {
+			break
+		}
+		if size+len(next)-nf.hdrLen > len(out) {
+			break
+		}
+
+		size += copy(out[size:], next[nf.hdrLen:])
+		payload += len(next) - nf.hdrLen
+		count++
+
+		if ff.proto == unix.IPPROTO_TCP {
+			out[ff.iphLen+13] |= next[nf.iphLen+13] & 0x08
+		}
+		// a short segment or PSH ends the super-packet
+		if len(next)-nf.hdrLen < gsoSize || nf.flags&0x08 != 0 {
+			break
+		}
+	}
+
+	if count == 1 {
+		return
+	}
+
+	var src, dst []byte
+	if ff.version == 4 {
+		binary.BigEndian.PutUint16(out[2:], uint16(size))
+		out[10], out[11] = 0, 0
+		binary.BigEndian.PutUint16(out[10:], Checksum(out[:ff.iphLen], 0))
+		src, dst = out[12:16], out[16:20]
+	} else {
+		binary.BigEndian.PutUint16(out[4:], uint16(size-40))
+		src, dst = out[8:24], out[24:40]
+	}
+
+	hdr.Flags = VnetFlagNeedsCsum
+	hdr.HdrLen = uint16(ff.hdrLen)
+	hdr.GSOSize = uint16(gsoSize)
+	hdr.CsumStart = uint16(ff.iphLen)
+
+	switch {
+	case ff.proto == unix.IPPROTO_UDP:
+		hdr.GSOType = VnetGSOUDPL4
+		hdr.CsumOffset = 6
+		binary.BigEndian.PutUint16(out[ff.iphLen+4:], uint16(size-ff.iphLen))
+	case ff.version == 4:
+		hdr.GSOType = VnetGSOTCPv4
+		hdr.CsumOffset = 16
+	default:
+		hdr.GSOType = VnetGSOTCPv6
+		hdr.CsumOffset = 16
+	}
+
+	at := ff.iphLen + int(hdr.CsumOffset)
+	psum := pseudoHeaderSum(ff.proto, src, dst, uint16(size-ff.iphLen))
+	binary.BigEndian.PutUint16(out[at:], checksumFold(psum))
+
+	return
+}
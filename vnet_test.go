@@ -0,0 +1,384 @@
+//go:build linux
+
+package tunnels
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	testSrc4 = []byte{10, 0, 0, 1}
+	testDst4 = []byte{10, 0, 0, 2}
+	testSrc6 = []byte{0xfd, 0, 15: 1}
+	testDst6 = []byte{0xfd, 0, 15: 2}
+)
+
+// testPacket builds a TCP or UDP packet with valid checksums, id is the
+// IPv4 ID and seq the TCP sequence number.
+func testPacket(version int, proto uint8, id uint16, seq uint32, flags byte, payload []byte) []byte {
+	iphLen, l4Len := 20, 8
+	if version == 6 {
+		iphLen = 40
+	}
+	if proto == unix.IPPROTO_TCP {
+		l4Len = 20
+	}
+	pkt := make([]byte, iphLen+l4Len+len(payload))
+	copy(pkt[iphLen+l4Len:], payload)
+
+	var src, dst []byte
+	if version == 4 {
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		binary.BigEndian.PutUint16(pkt[4:], id)
+		pkt[8], pkt[9] = 64, proto
+		copy(pkt[12:], testSrc4)
+		copy(pkt[16:], testDst4)
+		binary.BigEndian.PutUint16(pkt[10:], Checksum(pkt[:20], 0))
+		src, dst = testSrc4, testDst4
+	} else {
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)-40))
+		pkt[6], pkt[7] = proto, 64
+		copy(pkt[8:], testSrc6)
+		copy(pkt[24:], testDst6)
+		src, dst = testSrc6, testDst6
+	}
+
+	l4 := pkt[iphLen:]
+	binary.BigEndian.PutUint16(l4[0:], 1000)
+	binary.BigEndian.PutUint16(l4[2:], 2000)
+	csumAt := 6
+	if proto == unix.IPPROTO_TCP {
+		binary.BigEndian.PutUint32(l4[4:], seq)
+		binary.BigEndian.PutUint32(l4[8:], 1)
+		l4[12] = 5 << 4
+		l4[13] = flags
+		binary.BigEndian.PutUint16(l4[14:], 512)
+		csumAt = 16
+	} else {
+		binary.BigEndian.PutUint16(l4[4:], uint16(len(l4)))
+	}
+	psum := pseudoHeaderSum(proto, src, dst, uint16(len(l4)))
+	binary.BigEndian.PutUint16(l4[csumAt:], Checksum(l4, psum))
+	return pkt
+}
+
+func testPayload(size int, fill byte) []byte {
+	return bytes.Repeat([]byte{fill}, size)
+}
+
+func testBufs(n int) (bufs [][]byte, sizes []int) {
+	for i := 0; i < n; i++ {
+		bufs = append(bufs, make([]byte, 2048))
+	}
+	return bufs, make([]int, n)
+}
+
+func TestGSOSplit(t *testing.T) {
+	const (
+		ack = 0x10
+		psh = 0x08
+	)
+	tcp4 := []byte{
+		0x45, 0, 0, 0, 0, 7, 0, 0, 64, unix.IPPROTO_TCP, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2,
+	}
+
+	tests := []struct {
+		name  string
+		pkt   []byte
+		hdr   VirtioNetHdr
+		bufs  int
+		sizes int
+		want  [][]byte
+		err   bool
+	}{
+		{
+			name: "no gso",
+			pkt:  testPacket(4, unix.IPPROTO_UDP, 1, 0, 0, testPayload(100, 'a')),
+			bufs: 1, sizes: 1,
+			want: [][]byte{testPacket(4, unix.IPPROTO_UDP, 1, 0, 0, testPayload(100, 'a'))},
+		},
+		{
+			name: "tcp4",
+			pkt:  superPacket(t, testPacket(4, unix.IPPROTO_TCP, 7, 100, ack|psh, testPayload(2500, 'b'))),
+			hdr:  VirtioNetHdr{GSOType: VnetGSOTCPv4, GSOSize: 1000, CsumStart: 20, HdrLen: 40},
+			bufs: 4, sizes: 4,
+			want: [][]byte{
+				testPacket(4, unix.IPPROTO_TCP, 7, 100, ack, testPayload(1000, 'b')),
+				testPacket(4, unix.IPPROTO_TCP, 8, 1100, ack, testPayload(1000, 'b')),
+				testPacket(4, unix.IPPROTO_TCP, 9, 2100, ack|psh, testPayload(500, 'b')),
+			},
+		},
+		{
+			name: "udp6",
+			pkt:  superPacket(t, testPacket(6, unix.IPPROTO_UDP, 0, 0, 0, testPayload(2000, 'c'))),
+			hdr:  VirtioNetHdr{GSOType: VnetGSOUDPL4, GSOSize: 1000, CsumStart: 40, HdrLen: 48},
+			bufs: 2, sizes: 2,
+			want: [][]byte{
+				testPacket(6, unix.IPPROTO_UDP, 0, 0, 0, testPayload(1000, 'c')),
+				testPacket(6, unix.IPPROTO_UDP, 0, 0, 0, testPayload(1000, 'c')),
+			},
+		},
+		{
+			name: "too few bufs",
+			pkt:  testPacket(6, unix.IPPROTO_UDP, 0, 0, 0, testPayload(2000, 'c')),
+			hdr:  VirtioNetHdr{GSOType: VnetGSOUDPL4, GSOSize: 1000, CsumStart: 40},
+			bufs: 1, sizes: 1,
+			err: true,
+		},
+		{
+			name: "too few sizes",
+			pkt:  testPacket(6, unix.IPPROTO_UDP, 0, 0, 0, testPayload(2000, 'c')),
+			hdr:  VirtioNetHdr{GSOType: VnetGSOUDPL4, GSOSize: 1000, CsumStart: 40},
+			bufs: 2, sizes: 1,
+			err: true,
+		},
+		{
+			name: "no sizes",
+			pkt:  testPacket(4, unix.IPPROTO_UDP, 1, 0, 0, testPayload(10, 'a')),
+			bufs: 1, sizes: 0,
+			err: true,
+		},
+		{
+			name: "bad ip version",
+			pkt:  append([]byte{0x50}, make([]byte, 59)...),
+			hdr:  VirtioNetHdr{GSOType: VnetGSOTCPv6, GSOSize: 10, CsumStart: 20},
+			bufs: 4, sizes: 4,
+			err: true,
+		},
+		{
+			name: "csum start inside the ip header",
+			pkt:  testPacket(6, unix.IPPROTO_UDP, 0, 0, 0, testPayload(100, 'c')),
+			hdr:  VirtioNetHdr{GSOType: VnetGSOUDPL4, GSOSize: 10, CsumStart: 20},
+			bufs: 4, sizes: 4,
+			err: true,
+		},
+		{
+			name: "short tcp header",
+			pkt:  append(append(tcp4, make([]byte, 12)...), 0x10, ack, 0, 0, 0, 0, 0, 0),
+			hdr:  VirtioNetHdr{GSOType: VnetGSOTCPv4, GSOSize: 10, CsumStart: 20},
+			bufs: 4, sizes: 4,
+			err: true,
+		},
+		{
+			name: "zero gso size",
+			pkt:  testPacket(4, unix.IPPROTO_TCP, 1, 1, ack, testPayload(100, 'a')),
+			hdr:  VirtioNetHdr{GSOType: VnetGSOTCPv4, CsumStart: 20},
+			bufs: 4, sizes: 4,
+			err: true,
+		},
+		{
+			name: "unsupported gso type",
+			pkt:  testPacket(4, unix.IPPROTO_UDP, 1, 0, 0, testPayload(100, 'a')),
+			hdr:  VirtioNetHdr{GSOType: VnetGSOUDP, GSOSize: 10, CsumStart: 20},
+			bufs: 4, sizes: 4,
+			err: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bufs, sizes := testBufs(tt.bufs)
+			sizes = sizes[:tt.sizes]
+			n, err := GSOSplit(tt.pkt, tt.hdr, bufs, sizes)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("GSOSplit = %d, want an error", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(tt.want) {
+				t.Fatalf("GSOSplit = %d segments, want %d", n, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if got := bufs[i][:sizes[i]]; !bytes.Equal(got, want) {
+					t.Errorf("segment %d:\n got %x\nwant %x", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGSOSplitNeedsCsum(t *testing.T) {
+	want := testPacket(6, unix.IPPROTO_TCP, 0, 5, 0x10, testPayload(33, 'd'))
+	pkt := append([]byte(nil), want...)
+	// the kernel leaves the folded pseudo header sum in the checksum field
+	psum := pseudoHeaderSum(unix.IPPROTO_TCP, testSrc6, testDst6, uint16(len(pkt)-40))
+	binary.BigEndian.PutUint16(pkt[56:], checksumFold(psum))
+
+	bufs, sizes := testBufs(1)
+	hdr := VirtioNetHdr{Flags: VnetFlagNeedsCsum, CsumStart: 40, CsumOffset: 16}
+	n, err := GSOSplit(pkt, hdr, bufs, sizes)
+	if err != nil || n != 1 {
+		t.Fatalf("GSOSplit = %d, %v", n, err)
+	}
+	if got := bufs[0][:sizes[0]]; !bytes.Equal(got, want) {
+		t.Fatalf("got %x\nwant %x", got, want)
+	}
+}
+
+// superPacket turns a full packet into what the kernel hands over with
+// GSO, the L4 checksum left as the folded pseudo header sum.
+func superPacket(t *testing.T, pkt []byte) []byte {
+	t.Helper()
+	f, ok := parseFlow(pkt)
+	if !ok {
+		t.Fatal("invalid test packet")
+	}
+	var src, dst []byte
+	if f.version == 4 {
+		src, dst = pkt[12:16], pkt[16:20]
+	} else {
+		src, dst = pkt[8:24], pkt[24:40]
+	}
+	at := f.iphLen + 6
+	if f.proto == unix.IPPROTO_TCP {
+		at = f.iphLen + 16
+	}
+	psum := pseudoHeaderSum(f.proto, src, dst, uint16(len(pkt)-f.iphLen))
+	binary.BigEndian.PutUint16(pkt[at:], checksumFold(psum))
+	return pkt
+}
+
+func TestGROCoalesce(t *testing.T) {
+	const (
+		ack = 0x10
+		psh = 0x08
+	)
+	tests := []struct {
+		name  string
+		pkts  [][]byte
+		uso   bool
+		out   int
+		count int
+		gso   uint8
+	}{
+		{
+			name: "tcp4 flow",
+			pkts: [][]byte{
+				testPacket(4, unix.IPPROTO_TCP, 1, 100, ack, testPayload(1000, 'a')),
+				testPacket(4, unix.IPPROTO_TCP, 2, 1100, ack, testPayload(1000, 'a')),
+				testPacket(4, unix.IPPROTO_TCP, 3, 2100, ack|psh, testPayload(300, 'a')),
+				testPacket(4, unix.IPPROTO_TCP, 4, 2400, ack, testPayload(1000, 'a')),
+			},
+			count: 3,
+			gso:   VnetGSOTCPv4,
+		},
+		{
+			name: "tcp6 sequence gap",
+			pkts: [][]byte{
+				testPacket(6, unix.IPPROTO_TCP, 0, 100, ack, testPayload(500, 'a')),
+				testPacket(6, unix.IPPROTO_TCP, 0, 700, ack, testPayload(500, 'a')),
+			},
+			count: 1,
+		},
+		{
+			name: "tcp push on the first packet",
+			pkts: [][]byte{
+				testPacket(4, unix.IPPROTO_TCP, 1, 100, ack|psh, testPayload(500, 'a')),
+				testPacket(4, unix.IPPROTO_TCP, 2, 600, ack, testPayload(500, 'a')),
+			},
+			count: 1,
+		},
+		{
+			name: "udp6 flow",
+			pkts: [][]byte{
+				testPacket(6, unix.IPPROTO_UDP, 0, 0, 0, testPayload(800, 'b')),
+				testPacket(6, unix.IPPROTO_UDP, 0, 0, 0, testPayload(800, 'b')),
+				testPacket(6, unix.IPPROTO_UDP, 0, 0, 0, testPayload(100, 'b')),
+			},
+			uso:   true,
+			count: 3,
+			gso:   VnetGSOUDPL4,
+		},
+		{
+			name: "udp tiny payloads",
+			pkts: [][]byte{
+				testPacket(4, unix.IPPROTO_UDP, 1, 0, 0, testPayload(3, 'c')),
+				testPacket(4, unix.IPPROTO_UDP, 2, 0, 0, testPayload(3, 'c')),
+			},
+			uso:   true,
+			count: 2,
+			gso:   VnetGSOUDPL4,
+		},
+		{
+			name: "udp one byte",
+			pkts: [][]byte{
+				testPacket(4, unix.IPPROTO_UDP, 1, 0, 0, testPayload(1, 'c')),
+			},
+			uso:   true,
+			count: 1,
+		},
+		{
+			name: "udp without uso",
+			pkts: [][]byte{
+				testPacket(4, unix.IPPROTO_UDP, 1, 0, 0, testPayload(800, 'b')),
+				testPacket(4, unix.IPPROTO_UDP, 2, 0, 0, testPayload(800, 'b')),
+			},
+			count: 1,
+		},
+		{
+			name: "packet larger than out",
+			pkts: [][]byte{
+				testPacket(4, unix.IPPROTO_UDP, 1, 0, 0, testPayload(800, 'b')),
+			},
+			out:   100,
+			count: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.out == 0 {
+				tt.out = VnetMaxPacket
+			}
+			out := make([]byte, tt.out)
+			hdr, size, count := GROCoalesce(out, tt.pkts, tt.uso)
+			if count != tt.count {
+				t.Fatalf("GROCoalesce merged %d packets, want %d", count, tt.count)
+			}
+			if hdr.GSOType != tt.gso {
+				t.Fatalf("gso type %d, want %d", hdr.GSOType, tt.gso)
+			}
+			if count == 0 {
+				return
+			}
+			if count == 1 {
+				if hdr != (VirtioNetHdr{}) || !bytes.Equal(out[:size], tt.pkts[0]) {
+					t.Fatalf("single packet was changed: %+v", hdr)
+				}
+				return
+			}
+
+			// splitting the super-packet gives back the original packets
+			bufs, sizes := testBufs(count)
+			n, err := GSOSplit(out[:size], hdr, bufs, sizes)
+			if err != nil || n != count {
+				t.Fatalf("GSOSplit = %d, %v", n, err)
+			}
+			for i := 0; i < n; i++ {
+				if !bytes.Equal(bufs[i][:sizes[i]], tt.pkts[i]) {
+					t.Errorf("segment %d:\n got %x\nwant %x", i, bufs[i][:sizes[i]], tt.pkts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGSOSplitShortBuffer(t *testing.T) {
+	pkt := testPacket(4, unix.IPPROTO_UDP, 1, 0, 0, testPayload(100, 'a'))
+	_, err := GSOSplit(pkt, VirtioNetHdr{}, [][]byte{make([]byte, 50)}, make([]int, 1))
+	if !errors.Is(err, syscall.ENOBUFS) {
+		t.Fatalf("GSOSplit = %v, want ENOBUFS", err)
+	}
+}